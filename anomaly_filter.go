@@ -1,9 +1,11 @@
 package hekaanom
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"strconv"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/mozilla-services/heka/message"
@@ -13,41 +15,146 @@ import (
 const timeFormat = time.RFC3339Nano
 
 var (
-	defaultMessageVal    = 1.0
-	defaultMessageSeries = "**all**"
+	defaultMessageVal         = 1.0
+	defaultMessageSeries      = "**all**"
+	defaultMissingSeriesValue = "**none**"
+	defaultSeriesOverflow     = "Evict"
+	defaultTimeFormat         = "RFC3339"
+	// The most refused series named in each summary of refusals.
+	maxRefusedSeriesLogged = 5
 )
 
 func init() {
 	pipeline.RegisterPlugin("AnomalyFilter",
 		func() interface{} {
-			return &AnomalyFilter{
-				windower: new(windowFilter),
-				detector: new(detectFilter),
-				gatherer: new(gatherFilter),
-			}
+			return new(AnomalyFilter)
 		})
 }
 
 type AnomalyConfig struct {
 	// A space-delimited list of fields that should be used to group metrics into
-	// time series. The series code in messages will be the values of these
-	// fields joined by '||'. A single field is fine, but should still be given
-	// as an array.
+	// time series. The series code in messages will be the values of these fields
+	// joined by '|', with any '|' or '\' in the values escaped by a '\'. Each
+	// field's values are joined by ',', with any ',' or '\' in them escaped, even
+	// if there's only one. A single field is fine, but should still be given as an
+	// array. Rulings and spans also carry each field's unescaped values in its own
+	// "series.<field name>" field. Fields may also be named as in Heka's message
+	// matcher: "Type", "Logger", "Hostname", "Severity", "EnvVersion" and "Pid"
+	// refer to the message's headers, "Payload" to the length of its payload, and
+	// "Fields[name]" to a dynamic field.
 	SeriesFields []string `toml:"series_fields"`
 
+	// The value used in place of any of the SeriesFields that a message
+	// doesn't have, so that e.g. a message with only a 'page' of "a" and one
+	// with only a 'country' of "a" don't end up in the same series. Defaults
+	// to "**none**".
+	MissingSeriesValue string `toml:"missing_series_value"`
+
+	// A template for the series code, used instead of joining the values of
+	// the SeriesFields. Each "{field name}" in the template is replaced with
+	// that field's value, e.g. "{page} ({country})". Values are not escaped.
+	SeriesTemplate string `toml:"series_template"`
+
+	// Rules that normalize the values of the SeriesFields before they're made
+	// into a series code, e.g. by lowercasing them or stripping query strings,
+	// and that drop messages whose values should not be analyzed at all.
+	// Rulings and spans carry the normalized values, not the original ones.
+	// Rules are applied in order, and dropped messages are counted in the
+	// "MessagesExcluded" report field.
+	SeriesRules []*SeriesRuleConfig `toml:"series_rules"`
+
+	// Also analyze series that roll up the values of some of the SeriesFields,
+	// so that e.g. a drop spread thinly across every country still shows up
+	// in the page's total. "Prefixes" rolls up the fields from the last one
+	// back, e.g. per-(page, country), per-page, and the overall total.
+	// "Subsets" rolls up every combination of fields, e.g. per-country as
+	// well. Rolled-up field values are given as "**all**", and the total's
+	// series code is just "**all**". Rulings and spans carry a
+	// 'series_level' field with the number of fields that weren't rolled up.
+	// Any InputTransform is applied to each full series first, so roll-ups
+	// add up the increases of their counters rather than their readings.
+	// Defaults to "None".
+	SeriesRollup string `toml:"series_rollup"`
+
 	// The name of the field in the incoming message that contains the numeric
-	// value that should be used to create the time series.
+	// value that should be used to create the time series. The field may be of
+	// any type: strings are parsed, and booleans count as 1 or 0. Headers may
+	// be used as in SeriesFields, e.g. "Payload" for the payload's length. If
+	// the field is left unset, every message counts as 1.
 	ValueField string `toml:"value_field"`
 
+	// A list of fields in the incoming message that each contain a numeric
+	// value, as in ValueField. Each field makes its own time series, whose
+	// series code is the message's series code followed by '|' and the name
+	// of the field. The name of the field is also passed through to rulings
+	// and spans as 'value_field'. A field that's missing or can't be parsed
+	// is skipped, so that only its own series goes without the message; in
+	// strict mode, it's also logged and counted in the "MessagesDropped"
+	// report field. Only one of ValueField and ValueFields may be given.
+	ValueFields []string `toml:"value_fields"`
+
+	// How a value field that holds more than one value is reduced to a single
+	// number. Possible values are "First", "Last", "Sum", "Mean", "Min", and
+	// "Max". Defaults to "First".
+	ValueReduction string `toml:"value_reduction"`
+
+	// Drop messages whose value or time field is missing or can't be parsed,
+	// logging an error and counting them in the "MessagesDropped" report
+	// field. Otherwise, such messages count as 1 at the message's timestamp.
+	Strict bool `toml:"strict"`
+
+	// The name of the field in the incoming message that contains the time at
+	// which the metric actually occurred. Windows are then built on this time
+	// instead of the message's timestamp, which is useful when the timestamp
+	// is when the data was ingested, e.g. when backfilling.
+	TimeField string `toml:"time_field"`
+
+	// The format of TimeField. Possible values are "RFC3339", "UnixSeconds",
+	// "UnixMillis", "UnixNanos", or a Go time layout such as
+	// "2006-01-02 15:04:05". Unix times may be integers, doubles, or strings.
+	// Defaults to "RFC3339". Messages whose time can't be read fall back to
+	// their timestamp, unless Strict is set.
+	TimeFormat string `toml:"time_format"`
+
+	// The name of the field in the incoming message that contains the rate at
+	// which the metric was sampled, StatsD style, e.g. 0.1 if only one in ten
+	// events was sent. Each metric then counts 1/rate times towards the sum,
+	// mean, and count of its window. Metrics without the field, or with
+	// a rate outside of (0, 1], are treated as unsampled.
+	SampleRateField string `toml:"sample_rate_field"`
+
+	// InputTransform is applied to the values of incoming metrics before
+	// they're windowed. "Rate" treats each series' values as readings of
+	// a monotonically increasing counter, and replaces them with the
+	// per-second rate at which the counter increased since the series'
+	// previous reading. "Delta" replaces them with the increase itself. The
+	// first reading in each series only serves as a baseline. Defaults to
+	// "None".
+	InputTransform string `toml:"input_transform"`
+
+	// The value at which counters wrap around to zero when InputTransform is
+	// "Rate" or "Delta", e.g. 4294967296 for 32-bit counters. A counter that
+	// decreases is assumed to have wrapped around if its previous reading was
+	// more than half of CounterMax, and to have been reset to zero otherwise.
+	// Zero, the default, treats every decrease as a reset.
+	CounterMax float64 `toml:"counter_max"`
+
 	// Is this filter running against realtime data? i.e. is data going to keep
-	// coming in forever?
+	// coming in forever? If so, windows are closed on each timer tick once the
+	// wall clock is past their end by the window stage's `realtime_grace` (60
+	// seconds by default) plus its `allowed_lateness`, and series that stop
+	// receiving data produce empty windows.
 	Realtime bool `toml:"realtime"`
 
 	// The configuration for the filter which groups metrics together into
-	// regular time blocks. The value of each window is the sum of the
-	// constituent metric values.
+	// regular time blocks. The value of each window is, by default, the sum of
+	// the constituent metric values.
 	WindowConfig *WindowConfig `toml:"window"`
 
+	// The configuration for the filter that transforms the values of windows
+	// (e.g. by taking their log) before anomalies are detected in them.
+	TransformConfig *TransformConfig `toml:"transform"`
+
 	// The configuration for the filter that detects anomalies in a time series
 	// made of windows.
 	DetectConfig *DetectConfig `toml:"detect"`
@@ -56,29 +163,111 @@ type AnomalyConfig struct {
 	// anomalies into anomalous spans of time, a.k.a. anomalous events.
 	GatherConfig *GatherConfig `toml:"gather"`
 
+	// Additional resolutions at which to window the same metrics, each with
+	// its own window, transform, detect, and gather configuration. The
+	// sections above make up the first resolution, unless its 'window_width'
+	// is left unset and at least one resolution is listed here. Each
+	// resolution must have window and detect sections; one without a gather
+	// section doesn't gather its anomalies into spans. Every ruling and span
+	// carries the name of the resolution that produced it.
+	Resolutions []*ResolutionConfig `toml:"resolutions"`
+
+	// The maximum number of series to hold in memory at once. Zero, the
+	// default, means there's no limit.
+	MaxSeries int `toml:"max_series"`
+
+	// What to do with a metric from a new series once MaxSeries series are
+	// already in memory. "Evict" drops the least recently seen series from
+	// every stage to make room, while "Refuse" drops the new series' metrics.
+	// Refusals are logged in a summary on each timer tick, rather than one
+	// message per metric. Each series refused during a tick is counted once in
+	// the "SeriesRefused" report field, and its metrics in "MetricsRefused".
+	// Defaults to "Evict".
+	SeriesOverflow string `toml:"series_overflow"`
+
+	// The number of seconds after which a series that hasn't received any
+	// metrics is dropped from every stage. When realtime is set, this is
+	// measured against the wall clock; otherwise, it's measured against the
+	// latest metric timestamp. Zero, the default, means series never expire.
+	SeriesIdleTTL int64 `toml:"series_idle_ttl"`
+
 	// Output debugging information.
 	Debug bool `toml:"debug"`
 }
 
+// ResolutionConfig configures one of the resolutions at which metrics are
+// windowed, detected, and gathered.
+type ResolutionConfig struct {
+	WindowConfig    *WindowConfig    `toml:"window"`
+	TransformConfig *TransformConfig `toml:"transform"`
+	DetectConfig    *DetectConfig    `toml:"detect"`
+	GatherConfig    *GatherConfig    `toml:"gather"`
+}
+
 type AnomalyFilter struct {
 	runner pipeline.FilterRunner
 	helper pipeline.PluginHelper
 	*AnomalyConfig
-	windower   windower
-	detector   detector
-	gatherer   gatherer
-	metrics    chan metric
-	spans      chan span
-	processing bool
+	resolutions []*resolution
+	metrics     chan metric
+	processing  bool
+
+	valueReduction func([]float64) float64
+	seriesRules    []*seriesRule
+	rollupMasks    [][]bool
+	counters       *counterTransform
+	seriesLRU      *seriesLRU
+	latestMetric   time.Time
+	seriesTracked  int64
+	seriesEvicted  int64
+	seriesRefused  int64
+	metricsRefused int64
+	// The series refused since the last summary of refusals was logged, with
+	// the number of metrics refused from each.
+	refused map[string]int
+	// The number of messages, or values of ValueFields, dropped in strict
+	// mode.
+	messagesDropped int64
+	// The number of messages dropped by series rules.
+	messagesExcluded int64
+}
+
+// resolution is a single window, transform, detect, and gather pipeline.
+type resolution struct {
+	name        string
+	windower    windower
+	transformer transformer
+	detector    detector
+	gatherer    gatherer
+	windows     chan window
+	spans       chan span
+	*ResolutionConfig
+}
+
+func newResolution() *resolution {
+	return &resolution{
+		windower:    new(windowFilter),
+		transformer: new(transformFilter),
+		detector:    new(detectFilter),
+		gatherer:    new(gatherFilter),
+	}
 }
 
 // ConfigStruct implements Heka's HasConfigStruct interface.
 func (f *AnomalyFilter) ConfigStruct() interface{} {
+	res := newResolution()
 	return &AnomalyConfig{
-		WindowConfig: f.windower.ConfigStruct().(*WindowConfig),
-		DetectConfig: f.detector.ConfigStruct().(*DetectConfig),
-		GatherConfig: f.gatherer.ConfigStruct().(*GatherConfig),
-		Debug:        false,
+		WindowConfig:       res.windower.ConfigStruct().(*WindowConfig),
+		TransformConfig:    res.transformer.ConfigStruct().(*TransformConfig),
+		DetectConfig:       res.detector.ConfigStruct().(*DetectConfig),
+		GatherConfig:       res.gatherer.ConfigStruct().(*GatherConfig),
+		ValueReduction:     defaultValueReduction,
+		TimeFormat:         defaultTimeFormat,
+		MissingSeriesValue: defaultMissingSeriesValue,
+		SeriesRollup:       defaultSeriesRollup,
+		InputTransform:     defaultInputTransform,
+		SeriesOverflow:     defaultSeriesOverflow,
+		Debug:              false,
 	}
 }
 
@@ -87,35 +276,150 @@ func (f *AnomalyFilter) Init(config interface{}) error {
 	f.AnomalyConfig = config.(*AnomalyConfig)
 	f.processing = false
 
-	if err := f.windower.Init(f.AnomalyConfig.WindowConfig); err != nil {
-		return err
+	if f.AnomalyConfig.SeriesOverflow == "" {
+		f.AnomalyConfig.SeriesOverflow = defaultSeriesOverflow
 	}
-	if err := f.detector.Init(f.AnomalyConfig.DetectConfig); err != nil {
-		return err
+	if f.AnomalyConfig.SeriesOverflow != "Evict" && f.AnomalyConfig.SeriesOverflow != "Refuse" {
+		return errors.New("'series_overflow' must be either \"Evict\" or \"Refuse\".")
 	}
-	if err := f.gatherer.Init(f.AnomalyConfig.GatherConfig); err != nil {
-		return err
+	if f.AnomalyConfig.MaxSeries < 0 {
+		return errors.New("'max_series' must not be negative.")
+	}
+	if f.AnomalyConfig.SeriesIdleTTL < 0 {
+		return errors.New("'series_idle_ttl' must not be negative.")
+	}
+	f.seriesLRU = newSeriesLRU()
+	f.refused = map[string]int{}
+
+	if f.AnomalyConfig.ValueField != "" && len(f.AnomalyConfig.ValueFields) > 0 {
+		return errors.New("Only one of 'value_field' and 'value_fields' may be given.")
+	}
+	for _, conf := range f.AnomalyConfig.SeriesRules {
+		rule, err := newSeriesRule(conf)
+		if err != nil {
+			return err
+		}
+		f.seriesRules = append(f.seriesRules, rule)
+	}
+	if f.AnomalyConfig.SeriesRollup == "" {
+		f.AnomalyConfig.SeriesRollup = defaultSeriesRollup
+	}
+	if !rollupIsKnown(f.AnomalyConfig.SeriesRollup) {
+		return errors.New("Unknown 'series_rollup'.")
+	}
+	f.rollupMasks = rollupMasks(f.AnomalyConfig.SeriesRollup, len(f.AnomalyConfig.SeriesFields))
+	if f.AnomalyConfig.MissingSeriesValue == "" {
+		f.AnomalyConfig.MissingSeriesValue = defaultMissingSeriesValue
+	}
+	if f.AnomalyConfig.TimeFormat == "" {
+		f.AnomalyConfig.TimeFormat = defaultTimeFormat
+	}
+	if f.AnomalyConfig.ValueReduction == "" {
+		f.AnomalyConfig.ValueReduction = defaultValueReduction
+	}
+	reduction, ok := valueReductions[f.AnomalyConfig.ValueReduction]
+	if !ok {
+		return errors.New("Unknown 'value_reduction'.")
+	}
+	f.valueReduction = reduction
+
+	if f.AnomalyConfig.InputTransform == "" {
+		f.AnomalyConfig.InputTransform = defaultInputTransform
+	}
+	if !inputTransformIsKnown(f.AnomalyConfig.InputTransform) {
+		return errors.New("Unknown 'input_transform'.")
+	}
+	if f.AnomalyConfig.CounterMax < 0 {
+		return errors.New("'counter_max' must not be negative.")
+	}
+	if f.AnomalyConfig.InputTransform != "None" {
+		f.counters = newCounterTransform(f.AnomalyConfig.InputTransform, f.AnomalyConfig.CounterMax)
+	}
+
+	configs := f.AnomalyConfig.Resolutions
+	if f.AnomalyConfig.WindowConfig.WindowWidth != 0 || len(configs) == 0 {
+		first := &ResolutionConfig{
+			WindowConfig:    f.AnomalyConfig.WindowConfig,
+			TransformConfig: f.AnomalyConfig.TransformConfig,
+			DetectConfig:    f.AnomalyConfig.DetectConfig,
+			GatherConfig:    f.AnomalyConfig.GatherConfig,
+		}
+		configs = append([]*ResolutionConfig{first}, configs...)
+	}
+
+	f.resolutions = make([]*resolution, 0, len(configs))
+	names := map[string]bool{}
+	for _, conf := range configs {
+		res, err := initResolution(conf)
+		if err != nil {
+			return err
+		}
+		if names[res.name] {
+			return fmt.Errorf("Resolution '%s' is configured more than once.", res.name)
+		}
+		names[res.name] = true
+		f.resolutions = append(f.resolutions, res)
 	}
 
 	return nil
 }
 
+func initResolution(conf *ResolutionConfig) (*resolution, error) {
+	res := newResolution()
+	if conf.WindowConfig == nil {
+		return nil, errors.New("Each resolution must have a 'window' section.")
+	}
+	if err := res.windower.Init(conf.WindowConfig); err != nil {
+		return nil, err
+	}
+	res.name = conf.WindowConfig.Resolution
+
+	// There's no detector that works without configuration, so unlike the
+	// other stages, the detect stage can't fall back to its defaults.
+	if conf.DetectConfig == nil {
+		return nil, fmt.Errorf("Resolution '%s' must have a 'detect' section.", res.name)
+	}
+	if conf.TransformConfig == nil {
+		conf.TransformConfig = res.transformer.ConfigStruct().(*TransformConfig)
+	}
+	if conf.GatherConfig == nil {
+		conf.GatherConfig = &GatherConfig{Disabled: true}
+	}
+	res.ResolutionConfig = conf
+
+	if err := res.transformer.Init(conf.TransformConfig); err != nil {
+		return nil, fmt.Errorf("Resolution '%s': %s", res.name, err)
+	}
+	if err := res.detector.Init(conf.DetectConfig); err != nil {
+		return nil, fmt.Errorf("Resolution '%s': %s", res.name, err)
+	}
+	if err := res.gatherer.Init(conf.GatherConfig); err != nil {
+		return nil, fmt.Errorf("Resolution '%s': %s", res.name, err)
+	}
+	return res, nil
+}
+
 // Prepare implements Heka's Filter interface.
 func (f *AnomalyFilter) Prepare(fr pipeline.FilterRunner, h pipeline.PluginHelper) error {
 	f.runner = fr
 	f.helper = h
 	f.metrics = make(chan metric)
 
-	windows := f.windower.Connect(f.metrics)
-	rulings := f.detector.Connect(windows)
-
-	if f.AnomalyConfig.GatherConfig.Disabled {
-		f.publishRulings(rulings)
-	} else {
-		rulingChans := broadcastRuling(rulings, 2)
-		f.publishRulings(rulingChans[0])
-		f.spans = f.gatherer.Connect(rulingChans[1])
-		f.publishSpans(f.spans)
+	metricChans := broadcastMetric(f.metrics, len(f.resolutions))
+	for i, res := range f.resolutions {
+		res.windows = res.windower.Connect(metricChans[i])
+		f.publishLateMetrics(res.windower.LateMetrics(), res.name)
+		transformed := res.transformer.Connect(res.windows)
+		rulings := res.detector.Connect(transformed)
+
+		if res.GatherConfig.Disabled {
+			f.publishRulings(rulings)
+		} else {
+			rulingChans := broadcastRuling(rulings, 2)
+			f.publishRulings(rulingChans[0])
+			res.spans = res.gatherer.Connect(rulingChans[1])
+			f.publishSpans(res.spans)
+		}
 	}
 
 	return nil
@@ -123,8 +427,36 @@ func (f *AnomalyFilter) Prepare(fr pipeline.FilterRunner, h pipeline.PluginHelpe
 
 // ProcessMessage implements Heka's MessageProcessor interface.
 func (f *AnomalyFilter) ProcessMessage(pack *pipeline.PipelinePack) error {
-	metric := f.metricFromMessage(pack.Message)
-	f.metrics <- metric
+	groups, err := f.metricsFromMessage(pack.Message)
+	if err == errSeriesExcluded {
+		atomic.AddInt64(&f.messagesExcluded, 1)
+		f.runner.UpdateCursor(pack.QueueCursor)
+		return nil
+	}
+	if err != nil {
+		atomic.AddInt64(&f.messagesDropped, 1)
+		f.runner.LogError(fmt.Errorf("Dropped message: %s", err))
+		f.runner.UpdateCursor(pack.QueueCursor)
+		return nil
+	}
+	for _, group := range groups {
+		leaf := group[0]
+		sent := f.admitSeries(leaf) && (f.counters == nil || f.counters.Apply(&leaf))
+		if sent {
+			f.metrics <- leaf
+		}
+		// Roll-ups add up their leaves' increases rather than mixing the
+		// readings of different counters, so they need the leaf's increase.
+		if f.counters != nil && !sent {
+			continue
+		}
+		for _, rollup := range group[1:] {
+			rollup.Value = leaf.Value
+			if f.admitSeries(rollup) {
+				f.metrics <- rollup
+			}
+		}
+	}
 	f.runner.UpdateCursor(pack.QueueCursor)
 	if !f.processing {
 		f.processing = true
@@ -136,29 +468,140 @@ func (f *AnomalyFilter) ProcessMessage(pack *pipeline.PipelinePack) error {
 // TimerEvent implements Heka's TicketPlugin interface.
 func (f *AnomalyFilter) TimerEvent() error {
 	if f.AnomalyConfig.Debug {
-		f.detector.PrintQs()
-		f.gatherer.PrintSpansInMem()
+		for _, res := range f.resolutions {
+			fmt.Println("Resolution", res.name)
+			res.detector.PrintQs()
+			res.gatherer.PrintSpansInMem()
+		}
 	}
 
+	f.logRefusedSeries()
+
 	// We should only be keeping track of the real "now" if we're doing realtime
 	// analysis.
 	if f.AnomalyConfig.Realtime {
 		now := time.Now()
-		f.gatherer.FlushExpiredSpans(now, f.spans)
+		f.evictIdleSeries(now)
+		for _, res := range f.resolutions {
+			res.windower.FlushExpiredWindows(now, res.windows)
+			if res.spans != nil {
+				res.gatherer.FlushExpiredSpans(now, res.spans)
+			}
+		}
 	}
 
-	if f.processing && f.detector.QueuesEmpty() {
+	if f.processing && f.queuesEmpty() {
 		f.runner.LogMessage("All queues emptied.")
 		f.processing = false
 	}
 	return nil
 }
 
+// ReportMsg implements Heka's ReportingPlugin interface.
+func (f *AnomalyFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "SeriesTracked", atomic.LoadInt64(&f.seriesTracked), "count")
+	message.NewInt64Field(msg, "SeriesEvicted", atomic.LoadInt64(&f.seriesEvicted), "count")
+	message.NewInt64Field(msg, "SeriesRefused", atomic.LoadInt64(&f.seriesRefused), "count")
+	message.NewInt64Field(msg, "MetricsRefused", atomic.LoadInt64(&f.metricsRefused), "count")
+	message.NewInt64Field(msg, "MessagesDropped", atomic.LoadInt64(&f.messagesDropped), "count")
+	message.NewInt64Field(msg, "MessagesExcluded", atomic.LoadInt64(&f.messagesExcluded), "count")
+	return nil
+}
+
 // CleanUp implements Heka's Filter interface.
 func (f *AnomalyFilter) CleanUp() {
 	close(f.metrics)
 }
 
+// admitSeries decides whether metric's series may be held in memory, evicting
+// other series if needed to make room for it.
+func (f *AnomalyFilter) admitSeries(metric metric) bool {
+	if f.AnomalyConfig.MaxSeries == 0 && f.AnomalyConfig.SeriesIdleTTL == 0 {
+		return true
+	}
+
+	if !f.AnomalyConfig.Realtime {
+		if metric.Timestamp.After(f.latestMetric) {
+			f.latestMetric = metric.Timestamp
+		}
+		f.evictIdleSeries(f.latestMetric)
+	}
+
+	full := f.AnomalyConfig.MaxSeries > 0 && f.seriesLRU.Len() >= f.AnomalyConfig.MaxSeries
+	if full && !f.seriesLRU.Contains(metric.Series) {
+		if f.AnomalyConfig.SeriesOverflow == "Refuse" {
+			if _, ok := f.refused[metric.Series]; !ok {
+				atomic.AddInt64(&f.seriesRefused, 1)
+			}
+			f.refused[metric.Series]++
+			atomic.AddInt64(&f.metricsRefused, 1)
+			return false
+		}
+		oldest, _ := f.seriesLRU.Oldest()
+		f.evictSeries(oldest, "'max_series' reached")
+	}
+
+	f.seriesLRU.Touch(metric.Series, metric.Timestamp)
+	atomic.StoreInt64(&f.seriesTracked, int64(f.seriesLRU.Len()))
+	return true
+}
+
+// logRefusedSeries logs a summary of the series refused since it was last
+// called, so that a flood of new series doesn't become a flood of log
+// messages.
+func (f *AnomalyFilter) logRefusedSeries() {
+	if len(f.refused) == 0 {
+		return
+	}
+	series := make([]string, 0, len(f.refused))
+	metrics := 0
+	for name, count := range f.refused {
+		series = append(series, name)
+		metrics += count
+	}
+	sort.Strings(series)
+	named := series
+	if len(named) > maxRefusedSeriesLogged {
+		named = named[:maxRefusedSeriesLogged]
+	}
+	f.runner.LogMessage(fmt.Sprintf("Refused %d series (%d metrics) with %d series already in memory, including '%s'.",
+		len(series), metrics, f.seriesLRU.Len(), strings.Join(named, "', '")))
+	f.refused = map[string]int{}
+}
+
+func (f *AnomalyFilter) evictIdleSeries(now time.Time) {
+	if f.AnomalyConfig.SeriesIdleTTL == 0 {
+		return
+	}
+	ttl := time.Duration(f.AnomalyConfig.SeriesIdleTTL) * time.Second
+	for _, series := range f.seriesLRU.IdleSince(now.Add(-ttl)) {
+		f.evictSeries(series, "idle for longer than 'series_idle_ttl'")
+	}
+}
+
+// evictSeries drops series from every stage. The eviction travels down the
+// pipeline behind the series' earlier metrics, so each stage forgets the
+// series once it's done with them.
+func (f *AnomalyFilter) evictSeries(series string, reason string) {
+	f.seriesLRU.Remove(series)
+	if f.counters != nil {
+		f.counters.Evict(series)
+	}
+	f.metrics <- metric{Series: series, Evict: true}
+	atomic.AddInt64(&f.seriesEvicted, 1)
+	atomic.StoreInt64(&f.seriesTracked, int64(f.seriesLRU.Len()))
+	f.runner.LogMessage(fmt.Sprintf("Evicted series '%s': %s.", series, reason))
+}
+
+func (f *AnomalyFilter) queuesEmpty() bool {
+	for _, res := range f.resolutions {
+		if !res.detector.QueuesEmpty() {
+			return false
+		}
+	}
+	return true
+}
+
 func (f *AnomalyFilter) publishSpans(in chan span) error {
 	go func() {
 		for span := range in {
@@ -180,9 +623,39 @@ func (f *AnomalyFilter) publishSpans(in chan span) error {
 	return nil
 }
 
+func (f *AnomalyFilter) publishLateMetrics(in chan metric, resolution string) error {
+	go func() {
+		for metric := range in {
+			newPack, err := f.helper.PipelinePack(0)
+			if err != nil {
+				fmt.Println("Could not create new late metric message")
+				fmt.Println(err)
+				continue
+			}
+			msg := newPack.Message
+			msg.SetType("anom.late")
+			if err = metric.FillMessage(msg); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			resField, err := message.NewField("resolution", resolution, "")
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			msg.AddField(resField)
+			f.runner.Inject(newPack)
+		}
+	}()
+	return nil
+}
+
 func (f *AnomalyFilter) publishRulings(in chan ruling) error {
 	go func() {
 		for ruling := range in {
+			if ruling.Window.Evict {
+				continue
+			}
 			newPack, err := f.helper.PipelinePack(0)
 			if err != nil {
 				fmt.Println("Could not create new ruling message")
@@ -201,51 +674,157 @@ func (f *AnomalyFilter) publishRulings(in chan ruling) error {
 	return nil
 }
 
-func (f *AnomalyFilter) metricFromMessage(msg *message.Message) metric {
-	return metric{
-		time.Unix(0, msg.GetTimestamp()),
-		f.getMessageSeries(msg),
-		f.getMessageValue(msg),
-		f.getMessagePassthrough(msg),
+// metricsFromMessage returns the metrics in msg, grouped by the series they
+// belong to: each group starts with the metric for the message's own series,
+// followed by the metrics for the roll-ups of that series.
+func (f *AnomalyFilter) metricsFromMessage(msg *message.Message) ([][]metric, error) {
+	timestamp, err := f.getMessageTime(msg)
+	if err != nil {
+		return nil, err
+	}
+	sampleRate, err := f.getMessageSampleRate(msg)
+	if err != nil {
+		return nil, err
+	}
+	series, key, err := f.getMessageSeries(msg)
+	if err != nil {
+		return nil, err
+	}
+	passthrough, err := f.getMessagePassthrough(msg, key)
+	if err != nil {
+		return nil, err
+	}
+	base := metric{
+		Timestamp:   timestamp,
+		Series:      series,
+		SeriesKey:   key,
+		SampleRate:  sampleRate,
+		Passthrough: passthrough,
 	}
-}
 
-func (f *AnomalyFilter) getMessageSeries(msg *message.Message) string {
-	var series bytes.Buffer
-	var values []string
+	bases := []metric{base}
+	if len(f.rollupMasks) > 0 {
+		levelField, err := seriesLevelField(len(key))
+		if err != nil {
+			return nil, err
+		}
+		bases[0].Passthrough = append(base.Passthrough[:len(base.Passthrough):len(base.Passthrough)], levelField)
+		rollups, err := f.rollupMetrics(base)
+		if err != nil {
+			return nil, err
+		}
+		bases = append(bases, rollups...)
+	}
 
-	for _, field := range f.AnomalyConfig.SeriesFields {
-		f := msg.FindFirstField(field)
-		if f == nil {
+	if len(f.AnomalyConfig.ValueFields) == 0 {
+		value, err := f.getMessageValue(msg, f.AnomalyConfig.ValueField)
+		if err != nil {
+			return nil, err
+		}
+		for i := range bases {
+			bases[i].Value = value
+		}
+		return [][]metric{bases}, nil
+	}
+
+	groups := make([][]metric, 0, len(f.AnomalyConfig.ValueFields))
+	for _, name := range f.AnomalyConfig.ValueFields {
+		value, err := messageFloat(msg, name, f.valueReduction)
+		if err != nil {
+			// Only this field's series misses out on the message.
+			if f.AnomalyConfig.Strict {
+				atomic.AddInt64(&f.messagesDropped, 1)
+				f.runner.LogError(fmt.Errorf("Dropped value: %s", err))
+			}
 			continue
 		}
-		val := f.GetValueString()
-		values = append(values, val...)
+		fieldName, err := message.NewField("value_field", name, "")
+		if err != nil {
+			return nil, errors.New("Could not create 'value_field' field")
+		}
+		group := make([]metric, len(bases))
+		for i, base := range bases {
+			group[i] = base
+			group[i].Series = base.Series + string(seriesSeparator) + escapeSeriesValue(name, seriesSeparator)
+			group[i].Value = value
+			group[i].Passthrough = append(base.Passthrough[:len(base.Passthrough):len(base.Passthrough)], fieldName)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (f *AnomalyFilter) getMessageSeries(msg *message.Message) (string, seriesKey, error) {
+	if len(f.AnomalyConfig.SeriesFields) == 0 {
+		return defaultMessageSeries, nil, nil
 	}
 
-	for i, val := range values {
-		series.WriteString(val)
-		if i < len(values)-1 {
-			series.WriteString("|")
+	key := make(seriesKey, len(f.AnomalyConfig.SeriesFields))
+	for i, name := range f.AnomalyConfig.SeriesFields {
+		key[i] = seriesKeyPart{Name: fieldName(name), Value: f.AnomalyConfig.MissingSeriesValue}
+		field := messageField(msg, name)
+		var vals []string
+		if field != nil {
+			vals = fieldStrings(field)
+		}
+		vals, keep := applySeriesRules(f.seriesRules, name, vals)
+		if !keep {
+			return "", nil, errSeriesExcluded
+		}
+		if field != nil {
+			key[i].setValues(vals)
 		}
 	}
 
-	seriesStr := series.String()
-	if len(seriesStr) == 0 {
-		return defaultMessageSeries
+	if f.AnomalyConfig.SeriesTemplate != "" {
+		return key.Format(f.AnomalyConfig.SeriesTemplate), key, nil
 	}
-	return seriesStr
+	return key.String(), key, nil
 }
 
-func (f *AnomalyFilter) getMessagePassthrough(msg *message.Message) []*message.Field {
+// getMessagePassthrough returns the series fields of msg, to be passed
+// through to rulings and spans. Fields whose values were rewritten by series
+// rules are passed through with their rewritten values, so that they match
+// the series they ended up in.
+func (f *AnomalyFilter) getMessagePassthrough(msg *message.Message, key seriesKey) ([]*message.Field, error) {
 	var fields []*message.Field
-	for _, field := range f.AnomalyConfig.SeriesFields {
-		f := msg.FindFirstField(field)
-		if f != nil {
-			fields = append(fields, f)
+	for i, name := range f.AnomalyConfig.SeriesFields {
+		field := messageField(msg, name)
+		if field == nil {
+			continue
+		}
+		values := key[i].Values
+		if len(values) == 0 {
+			values = []string{key[i].Value}
 		}
+		if stringsEqual(values, fieldStrings(field)) {
+			fields = append(fields, field)
+			continue
+		}
+		rewritten, err := message.NewField(field.GetName(), values[0], "")
+		if err != nil {
+			return nil, fmt.Errorf("Could not create '%s' field", field.GetName())
+		}
+		for _, value := range values[1:] {
+			if err := rewritten.AddValue(value); err != nil {
+				return nil, fmt.Errorf("Could not create '%s' field", field.GetName())
+			}
+		}
+		fields = append(fields, rewritten)
 	}
-	return fields
+	return fields, nil
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func broadcastSpan(in chan span, numOut int) []chan span {
@@ -268,6 +847,26 @@ func broadcastSpan(in chan span, numOut int) []chan span {
 	return out
 }
 
+func broadcastMetric(in chan metric, numOut int) []chan metric {
+	out := make([]chan metric, numOut)
+	for i := 0; i < numOut; i++ {
+		out[i] = make(chan metric)
+	}
+	go func() {
+		defer func() {
+			for _, ch := range out {
+				close(ch)
+			}
+		}()
+		for msg := range in {
+			for _, ch := range out {
+				ch <- msg
+			}
+		}
+	}()
+	return out
+}
+
 func broadcastRuling(in chan ruling, numOut int) []chan ruling {
 	out := make([]chan ruling, numOut)
 	for i := 0; i < numOut; i++ {
@@ -288,17 +887,45 @@ func broadcastRuling(in chan ruling, numOut int) []chan ruling {
 	return out
 }
 
-func (f *AnomalyFilter) getMessageValue(msg *message.Message) float64 {
-	if f.AnomalyConfig.ValueField == "" {
-		return defaultMessageVal
+func (f *AnomalyFilter) getMessageValue(msg *message.Message, name string) (float64, error) {
+	if name == "" {
+		return defaultMessageVal, nil
 	}
-	value, ok := msg.GetFieldValue(f.AnomalyConfig.ValueField)
-	if !ok {
-		return defaultMessageVal
+	value, err := messageFloat(msg, name, f.valueReduction)
+	if err != nil {
+		if f.AnomalyConfig.Strict {
+			return 0.0, err
+		}
+		return defaultMessageVal, nil
+	}
+	return value, nil
+}
+
+func (f *AnomalyFilter) getMessageTime(msg *message.Message) (time.Time, error) {
+	timestamp := time.Unix(0, msg.GetTimestamp())
+	if f.AnomalyConfig.TimeField == "" {
+		return timestamp, nil
 	}
-	floatVal, err := strconv.ParseFloat(value.(string), 64)
+	eventTime, err := messageTime(msg, f.AnomalyConfig.TimeField, f.AnomalyConfig.TimeFormat)
 	if err != nil {
-		return defaultMessageVal
+		if f.AnomalyConfig.Strict {
+			return time.Time{}, err
+		}
+		return timestamp, nil
+	}
+	return eventTime, nil
+}
+
+func (f *AnomalyFilter) getMessageSampleRate(msg *message.Message) (float64, error) {
+	if f.AnomalyConfig.SampleRateField == "" {
+		return 0.0, nil
+	}
+	if messageField(msg, f.AnomalyConfig.SampleRateField) == nil {
+		return 0.0, nil
+	}
+	rate, err := messageFloat(msg, f.AnomalyConfig.SampleRateField, valueReductions[defaultValueReduction])
+	if err != nil && f.AnomalyConfig.Strict {
+		return 0.0, err
 	}
-	return floatVal
+	return rate, nil
 }
@@ -0,0 +1,74 @@
+package hekaanom
+
+import "time"
+
+var (
+	defaultInputTransform = "None"
+	inputTransforms       = []string{"None", "Rate", "Delta"}
+)
+
+// counterTransform turns successive readings of monotonically increasing
+// counters into the amount they increased by, or the rate at which they did.
+type counterTransform struct {
+	perSecond  bool
+	counterMax float64
+	last       map[string]counterReading
+}
+
+type counterReading struct {
+	timestamp time.Time
+	value     float64
+}
+
+func newCounterTransform(transform string, counterMax float64) *counterTransform {
+	return &counterTransform{
+		perSecond:  transform == "Rate",
+		counterMax: counterMax,
+		last:       map[string]counterReading{},
+	}
+}
+
+// Apply replaces m's counter reading with its increase (or rate of increase)
+// since the previous reading in its series. It returns false if there's
+// nothing to pass on, i.e. m is the first reading in its series or is older
+// than the previous one.
+func (t *counterTransform) Apply(m *metric) bool {
+	prev, ok := t.last[m.Series]
+	if ok && !m.Timestamp.After(prev.timestamp) {
+		return false
+	}
+	t.last[m.Series] = counterReading{m.Timestamp, m.Value}
+	if !ok {
+		return false
+	}
+
+	delta := m.Value - prev.value
+	if delta < 0 {
+		if t.counterMax > 0 && prev.value > t.counterMax/2 {
+			// The counter wrapped around.
+			delta = t.counterMax - prev.value + m.Value
+		} else {
+			// The counter was reset to zero and has counted up from there.
+			delta = m.Value
+		}
+	}
+
+	if t.perSecond {
+		delta /= m.Timestamp.Sub(prev.timestamp).Seconds()
+	}
+	m.Value = delta
+	return true
+}
+
+func (t *counterTransform) Evict(series string) {
+	delete(t.last, series)
+}
+
+func inputTransformIsKnown(transform string) bool {
+	for _, v := range inputTransforms {
+		if v == transform {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+const (
+	defaultCUSUMDrift     = 0.5
+	defaultCUSUMThreshold = 5.0
+	defaultCUSUMWarmUp    = 20
+)
+
+func init() {
+	RegisterDetector("CUSUM", func() Detector {
+		return new(cUSUMDetector)
+	})
+}
+
+// cUSUMDetector looks for lasting shifts in a series' level with a two-sided
+// CUSUM chart. Each series' first `warm_up` windows (default 20) set its
+// target mean and standard deviation. After that, the upper and lower
+// cumulative sums of each window's deviation from the target, less `drift`
+// (default 0.5), are kept in standard deviations, and a window is ruled
+// anomalous when either sum goes over `threshold` (default 5). On an alarm,
+// both sums are reset and the target is learned again from the next
+// `warm_up` windows, so that a step change is flagged once rather than for
+// ever after.
+// Anomalousness is the larger cumulative sum, negative for the lower one, and
+// Normed the estimated size of the shift, in the series' units.
+type cUSUMDetector struct {
+	drift     float64
+	threshold float64
+	warmUp    int
+	series    map[string]*cUSUMState
+}
+
+type cUSUMState struct {
+	// Welford's running mean and sum of squares of the target, used while
+	// warming up.
+	seen  int
+	mean  float64
+	m2    float64
+	sigma float64
+	upper float64
+	lower float64
+	// How many windows each sum has been above zero for.
+	upperRun int
+	lowerRun int
+}
+
+func (d *cUSUMDetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	var err error
+	if d.drift, err = configFloat(conf, "drift", defaultCUSUMDrift); err != nil {
+		return err
+	}
+	if d.drift < 0 {
+		return errors.New("'drift' must be >= 0")
+	}
+	if d.threshold, err = configFloat(conf, "threshold", defaultCUSUMThreshold); err != nil {
+		return err
+	}
+	if d.threshold <= 0 {
+		return errors.New("'threshold' must be > 0")
+	}
+	if d.warmUp, err = configInt(conf, "warm_up", defaultCUSUMWarmUp); err != nil {
+		return err
+	}
+	if d.warmUp < 2 {
+		return errors.New("'warm_up' must be >= 2")
+	}
+	d.series = map[string]*cUSUMState{}
+	return nil
+}
+
+func (d *cUSUMDetector) Detect(win window, out chan ruling) {
+	if win.Missing() {
+		out <- detectRuling(win, false, 0.0, 0.0)
+		return
+	}
+
+	state, ok := d.series[win.Series]
+	if !ok {
+		state = &cUSUMState{}
+		d.series[win.Series] = state
+	}
+
+	if state.seen < d.warmUp {
+		state.seen++
+		delta := win.Value - state.mean
+		state.mean += delta / float64(state.seen)
+		state.m2 += delta * (win.Value - state.mean)
+		if state.seen == d.warmUp {
+			state.sigma = math.Sqrt(state.m2 / float64(state.seen-1))
+		}
+		out <- detectRuling(win, false, 0.0, 0.0)
+		return
+	}
+
+	sigma := stdDevFloor(state.sigma, state.mean)
+	z := (win.Value - state.mean) / sigma
+	state.upper = math.Max(0, state.upper+z-d.drift)
+	state.lower = math.Max(0, state.lower-z-d.drift)
+	state.upperRun = cUSUMRun(state.upper, state.upperRun)
+	state.lowerRun = cUSUMRun(state.lower, state.lowerRun)
+
+	statistic, shift := 0.0, 0.0
+	if state.upper >= state.lower && state.upper > 0 {
+		statistic = state.upper
+		shift = sigma * (d.drift + state.upper/float64(state.upperRun))
+	} else if state.lower > 0 {
+		statistic = -state.lower
+		shift = -sigma * (d.drift + state.lower/float64(state.lowerRun))
+	}
+
+	anomalous := math.Abs(statistic) > d.threshold
+	if anomalous {
+		*state = cUSUMState{}
+	}
+
+	out <- detectRuling(win, anomalous, statistic, shift)
+}
+
+func (d *cUSUMDetector) Evict(series string) {
+	delete(d.series, series)
+}
+
+// cUSUMRun counts how many windows in a row a cumulative sum has been above
+// zero.
+func cUSUMRun(sum float64, run int) int {
+	if sum > 0 {
+		return run + 1
+	}
+	return 0
+}
@@ -0,0 +1,40 @@
+package hekaanom
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+func TestCUSUMDetectsStepChanges(t *testing.T) {
+	// A level of 10, jittering by one either way.
+	level := func(base float64, n int) []float64 {
+		values := make([]float64, n)
+		for i := range values {
+			values[i] = base + float64(i%3-1)
+		}
+		return values
+	}
+	tests := []struct {
+		name   string
+		values []float64
+		want   []int
+	}{
+		{"flat", level(10, 60), nil},
+		// After 20 windows of warm up, a shift of about 12 standard deviations
+		// goes over the threshold on its first window, and the new level is
+		// then learned rather than flagged again.
+		{"up", append(level(10, 30), level(20, 40)...), []int{30}},
+		{"down", append(level(10, 30), level(0, 40)...), []int{30}},
+	}
+	for _, test := range tests {
+		d := new(cUSUMDetector)
+		if err := d.Init(pipeline.PluginConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		if got := anomalousAt(detectValues(t, d, test.values)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: anomalous at %v, want %v", test.name, got, test.want)
+		}
+	}
+}
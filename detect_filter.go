@@ -10,8 +10,6 @@ import (
 	"github.com/mozilla-services/heka/pipeline"
 )
 
-var algos = []string{"RPCA"}
-
 const defaultAlgo = "RPCA"
 
 type detector interface {
@@ -23,8 +21,9 @@ type detector interface {
 }
 
 type DetectConfig struct {
-	// The algorithm that should be used to detect anomalies. Right now, the only
-	// option is "RPCA".
+	// The algorithm that should be used to detect anomalies. This package
+	// provides "RPCA", "EWMA", "MAD", "HoltWinters", "SHESD" and "CUSUM", and
+	// others may be added with RegisterDetector.
 	Algorithm string `toml:"algorithm"`
 
 	// The configuration for the selected anomaly detection algorithm.
@@ -32,13 +31,8 @@ type DetectConfig struct {
 	maxProcs       int                   `toml:"max_procs"`
 }
 
-type detectAlgo interface {
-	Init(config interface{}) error
-	Detect(win window, out chan ruling)
-}
-
 type detectFilter struct {
-	Detectors []detectAlgo
+	Detectors []Detector
 	*DetectConfig
 	chans     []chan window
 	seriesToI map[string]int
@@ -57,18 +51,19 @@ func (f *detectFilter) Init(config interface{}) error {
 	if f.DetectConfig.Algorithm == "" {
 		return errors.New("No 'algorithm' specified.")
 	}
-	if !algoIsKnown(f.DetectConfig.Algorithm) {
-		return errors.New("Unknown algorithm.")
+	if f.DetectConfig.maxProcs <= 0 {
+		f.DetectConfig.maxProcs = runtime.GOMAXPROCS(0)
 	}
-	f.Detectors = make([]detectAlgo, f.DetectConfig.maxProcs)
-	switch f.DetectConfig.Algorithm {
-	case "RPCA":
-		for i := 0; i < f.DetectConfig.maxProcs; i++ {
-			f.Detectors[i] = new(rPCADetector)
-			if err := f.Detectors[i].Init(f.DetectConfig.DetectorConfig); err != nil {
-				return err
-			}
+	f.Detectors = make([]Detector, f.DetectConfig.maxProcs)
+	for i := 0; i < f.DetectConfig.maxProcs; i++ {
+		detector, ok := newDetector(f.DetectConfig.Algorithm)
+		if !ok {
+			return errors.New("Unknown algorithm.")
+		}
+		if err := detector.Init(f.DetectConfig.DetectorConfig); err != nil {
+			return err
 		}
+		f.Detectors[i] = detector
 	}
 	f.seriesToI = make(map[string]int, f.DetectConfig.maxProcs)
 	f.chans = make([]chan window, f.DetectConfig.maxProcs)
@@ -105,8 +100,13 @@ func (f *detectFilter) Connect(in chan window) chan ruling {
 	out := make(chan ruling)
 	wg.Add(f.DetectConfig.maxProcs)
 
-	detect := func(detector detectAlgo, in chan window, out chan ruling) {
+	detect := func(detector Detector, in chan window, out chan ruling) {
 		for window := range in {
+			if window.Evict {
+				detector.Evict(window.Series)
+				out <- ruling{Window: window}
+				continue
+			}
 			detector.Detect(window, out)
 		}
 		wg.Done()
@@ -121,6 +121,14 @@ func (f *detectFilter) Connect(in chan window) chan ruling {
 		defer close(out)
 		for window := range in {
 			i, ok := f.seriesToI[window.Series]
+			if window.Evict {
+				// Only the detector that has seen this series needs to hear about it.
+				if ok {
+					delete(f.seriesToI, window.Series)
+					f.chans[i] <- window
+				}
+				continue
+			}
 			if !ok {
 				i = f.seriesIndex(window.Series, f.DetectConfig.maxProcs-1)
 				f.seriesToI[window.Series] = i
@@ -134,6 +142,41 @@ func (f *detectFilter) Connect(in chan window) chan ruling {
 	return out
 }
 
+// detectRuling builds a ruling for win, never ruling missing windows anomalous.
+func detectRuling(win window, anomalous bool, anomalousness, normed float64) ruling {
+	if win.Missing() {
+		return ruling{Window: win, Passthrough: win.Passthrough}
+	}
+	return ruling{
+		Window:        win,
+		Anomalous:     anomalous,
+		Anomalousness: anomalousness,
+		Normed:        normed,
+		Passthrough:   win.Passthrough,
+	}
+}
+
+// windowValues returns the values of wins, standing in for missing windows
+// with the last value we actually saw so they don't look like a drop to zero.
+// Missing windows at the start take the first value we actually saw.
+func windowValues(wins []*window) []float64 {
+	values := make([]float64, len(wins))
+	last := 0.0
+	for _, win := range wins {
+		if !win.Missing() {
+			last = win.Value
+			break
+		}
+	}
+	for i, win := range wins {
+		if !win.Missing() {
+			last = win.Value
+		}
+		values[i] = last
+	}
+	return values
+}
+
 func iFromHash(series string, maxI int) int {
 	checksum := md5.Sum([]byte(series))
 	sum := 0
@@ -154,12 +197,3 @@ func (f *detectFilter) seriesIndex(series string, maxI int) int {
 	}
 	return i
 }
-
-func algoIsKnown(algo string) bool {
-	for _, v := range algos {
-		if v == algo {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,65 @@
+package hekaanom
+
+import (
+	"testing"
+	"time"
+)
+
+// detectValues runs values through d as consecutive hourly windows of one
+// series, and returns which of them it ruled anomalous.
+func detectValues(t *testing.T, d Detector, values []float64) []bool {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	out := make(chan ruling, len(values))
+	anomalous := make([]bool, 0, len(values))
+	for i, value := range values {
+		d.Detect(window{
+			Start:  start.Add(time.Duration(i) * time.Hour),
+			End:    start.Add(time.Duration(i+1) * time.Hour),
+			Series: "test",
+			Value:  value,
+		}, out)
+		select {
+		case r := <-out:
+			anomalous = append(anomalous, r.Anomalous)
+		default:
+			t.Fatalf("no ruling for window %d", i)
+		}
+	}
+	return anomalous
+}
+
+// anomalousAt returns the indexes of the windows ruled anomalous.
+func anomalousAt(anomalous []bool) []int {
+	var at []int
+	for i, a := range anomalous {
+		if a {
+			at = append(at, i)
+		}
+	}
+	return at
+}
+
+func TestWindowValuesFillsMissingWindows(t *testing.T) {
+	missing := window{Fill: "Missing"}
+	tests := []struct {
+		wins []window
+		want []float64
+	}{
+		{[]window{{Value: 1}, missing, {Value: 3}}, []float64{1, 1, 3}},
+		{[]window{missing, missing, {Value: 4}, missing}, []float64{4, 4, 4, 4}},
+		{[]window{missing, missing}, []float64{0, 0}},
+	}
+	for _, test := range tests {
+		wins := make([]*window, len(test.wins))
+		for i := range test.wins {
+			wins[i] = &test.wins[i]
+		}
+		got := windowValues(wins)
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("windowValues(%v) = %v, want %v", test.wins, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package hekaanom
+
+import (
+	"fmt"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// configInt reads an integer setting from a detector's config, falling back
+// to def if it isn't given.
+func configInt(conf pipeline.PluginConfig, name string, def int) (int, error) {
+	val, ok := conf[name]
+	if !ok {
+		return def, nil
+	}
+	i, ok := val.(int64)
+	if !ok {
+		return 0, fmt.Errorf("'%s' must be an integer", name)
+	}
+	return int(i), nil
+}
+
+// configFloat reads a numeric setting from a detector's config, falling back
+// to def if it isn't given. Integers are accepted too, so that e.g. `k = 3`
+// works as well as `k = 3.0`.
+func configFloat(conf pipeline.PluginConfig, name string, def float64) (float64, error) {
+	val, ok := conf[name]
+	if !ok {
+		return def, nil
+	}
+	switch val := val.(type) {
+	case float64:
+		return val, nil
+	case int64:
+		return float64(val), nil
+	}
+	return 0.0, fmt.Errorf("'%s' must be a number", name)
+}
@@ -0,0 +1,72 @@
+package hekaanom
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Window is a single, regularly-spaced data point of a time series, as handed
+// to a Detector.
+type Window = window
+
+// Ruling is a Detector's verdict on a single Window.
+type Ruling = ruling
+
+// A Detector is an anomaly detection algorithm that can be used by the detect
+// stage. The detect stage shards series across a number of goroutines, each
+// with its own Detector, so a Detector only ever sees a series from a single
+// goroutine and needn't do any locking of its own.
+type Detector interface {
+	// Init is called once, before any windows are detected, with the
+	// `config` section of the detect stage's configuration as
+	// a pipeline.PluginConfig. Integer values in it are int64s, and real
+	// values float64s.
+	Init(config interface{}) error
+
+	// Detect is called with every window of each series the Detector is
+	// responsible for, in order. It must send exactly one Ruling to out for
+	// every window it's given, though it may hold on to windows and send
+	// their rulings later, as long as each series' rulings stay in order.
+	// Windows for which win.Missing() is true hold no data, and shouldn't be
+	// ruled anomalous.
+	Detect(win Window, out chan Ruling)
+
+	// Evict drops everything the Detector holds for the given series. Any
+	// windows of the series that haven't been ruled on yet may be dropped.
+	Evict(series string)
+}
+
+// A DetectorFactory returns a new, uninitialized Detector.
+type DetectorFactory func() Detector
+
+var (
+	detectorsMu sync.RWMutex
+	detectors   = map[string]DetectorFactory{}
+)
+
+// RegisterDetector makes a detection algorithm available to the detect stage
+// under the given name, which is what the detect stage's `algorithm` setting
+// should be set to in order to use it. It's meant to be called from the init
+// function of the package providing the algorithm, and panics if the name is
+// already taken.
+func RegisterDetector(name string, factory DetectorFactory) {
+	detectorsMu.Lock()
+	defer detectorsMu.Unlock()
+	if factory == nil {
+		panic("hekaanom: RegisterDetector factory is nil")
+	}
+	if _, dup := detectors[name]; dup {
+		panic(fmt.Sprintf("hekaanom: RegisterDetector called twice for '%s'", name))
+	}
+	detectors[name] = factory
+}
+
+func newDetector(name string) (Detector, bool) {
+	detectorsMu.RLock()
+	defer detectorsMu.RUnlock()
+	factory, ok := detectors[name]
+	if !ok {
+		return nil, false
+	}
+	return factory(), true
+}
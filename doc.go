@@ -19,34 +19,74 @@ are injected into the Heka pipeline for use by subsequent stages with the types
 "anom.ruling" and "anom.span".
 
 The plugin itself has a general configuration section in the Heka configuration
-file, and each stage also has its own configuation section.
+file, and each stage also has its own configuation section. The same metrics
+may be run through the three stages at several resolutions (e.g. hourly and
+daily windows) by listing further stage configurations under `resolutions`;
+every ruling and span is tagged with the name of its resolution.
 
 Turning incoming data into time series consists of a number of steps. First,
 Heka's message matcher syntax
 (http://hekad.readthedocs.io/en/v0.10.0/message_matcher.html) is used to
 indicate which messages in the stream contain the intended data. Second, the
 time and value components of each data point are extracted from the filtered
-messages. The time component is pulled from the message's timestamp, while the
-`value_field`, specified in the plugin's configuration, is used as the data
-point's numeric value. Third, data points are split into independent time
-series based on the related message's `series_fields`. This is in place so that
-data pertaining to a number of time series may be fed into Heka at the same
-time. For example, if one wants to detect anomalies in the number of hourly
-visits to 10 different web pages, but all the page requests are coming in in
-real-time and are interspersed, the message field that contains the web page
-URL could be indiciated as the `series_field`, and a time series for each
-unique URL would be created. Finally, data points in each time series are
-bundled together into windows of regular and configurable "width". This is
-effectively downsampling to a regular interval. Right now, all value fields of
-the data points that fall within a window are added together to determine the
-window's value.
+messages. The time component is pulled from the message's timestamp (or from
+the `time_field`, if given), while the `value_field`, specified in the plugin's
+configuration, is used as the data point's numeric value. If the values are
+readings of ever-increasing counters, the `input_transform` setting can turn
+them into per-second rates or deltas, taking counter resets and wraparounds into
+account. Third, data points are split into independent time series based on the
+related message's `series_fields`, which may name the message's headers (e.g.
+`Hostname` or `Logger`) as well as its fields. This is in place so that data
+pertaining to a number of time series may be fed into Heka at the same time. For
+example, if one wants to detect anomalies in the number of hourly visits to 10
+different web pages, but all the page requests are coming in in real-time and
+are interspersed, the message field that contains the web page URL could be
+indiciated as the `series_field`, and a time series for each unique URL would be
+created. The `series_rollup` setting additionally creates aggregate series that
+roll up some of the series fields (e.g. per page across every country, and the
+overall total), each tagged with its level in the hierarchy.
+Finally, data points in each time series are bundled together into windows of
+regular and configurable "width". This is effectively downsampling to a regular
+interval. Window boundaries are aligned to multiples of the window width since
+the Unix epoch (optionally shifted by an offset and aligned in a given time
+zone), so windows for every series line up with one another. Window widths may
+also be given in calendar days, weeks, or months, which follow the configured
+time zone across daylight saving changes. Windows may also overlap, with a new
+window starting every `window_slide` units. By default, all value fields of the
+data points that fall within a window are added together to determine the
+window's value, but the window stage's `aggregation` setting can instead take
+their mean, minimum, maximum, last value, count, or a percentile. Periods in
+which a series receives no data can be skipped or filled in, depending on the
+window stage's `fill` setting. Metrics may arrive out of order by up to the
+window stage's `allowed_lateness`; metrics that arrive later than that are
+injected into the Heka pipeline as "anom.late" messages rather than being added
+to windows that have already been passed on.
 
 Time series, which now consist of a sequence of windows, are passed on to the
-detect stage. The detect stage uses a configurable anomaly detection algorithm
-to to determine which windows are anomalous, and by how much.  Right now, the
-only algorithm included in this package is Robust Primary Component Analysis
-("RPCA"). The anomaly detection algorithm creates a ruling for every window is
-receives, and injects these rulings into Heka's message pipeline.
+detect stage, optionally by way of a transform (e.g. a log or Box-Cox
+transform) that tames series spanning several orders of magnitude. Rulings
+carry both the transformed value and the window's original value. The detect
+stage uses a configurable anomaly detection algorithm to to determine which
+windows are anomalous, and by how much. This package includes:
+
+	RPCA         Robust Primary Component Analysis, which suits long, seasonal
+	             series.
+	EWMA         an exponentially weighted moving average, which flags windows
+	             more than `k` standard deviations from the series' recent
+	             mean and needs only a short `warm_up`.
+	MAD          a rolling median and median absolute deviation, which isn't
+	             thrown off by spiky series.
+	HoltWinters  Holt-Winters seasonal forecasting, which flags windows that
+	             fall outside a prediction interval and is updated window by
+	             window.
+	SHESD        Seasonal Hybrid ESD, which tests what's left after removing
+	             each series' seasonal pattern and median for outliers.
+	CUSUM        a two-sided CUSUM chart, which is quick to flag lasting
+	             shifts in a series' level.
+
+Other packages may add their own algorithms with RegisterDetector. The anomaly
+detection algorithm creates a ruling for every window is receives, and injects
+these rulings into Heka's message pipeline.
 
 The gather stage listens to the stream of rulings and gathers consecutive
 anomalous rulings together into anomalous events. Anomalous rulings need not be
@@ -0,0 +1,109 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+const (
+	defaultEWMAAlpha  = 0.3
+	defaultEWMAK      = 3.0
+	defaultEWMAWarmUp = 10
+)
+
+func init() {
+	RegisterDetector("EWMA", func() Detector {
+		return new(eWMADetector)
+	})
+}
+
+// eWMADetector rules a window anomalous when it lies more than k standard
+// deviations from its series' exponentially weighted moving mean. It's
+// configured with `alpha`, the weight given to each new window (default 0.3),
+// `k` (default 3), and `warm_up`, the number of windows each series must have
+// before any can be ruled anomalous (default 10). Anomalousness is the
+// window's z-score, and Normed its difference from the mean.
+type eWMADetector struct {
+	alpha  float64
+	k      float64
+	warmUp int
+	series map[string]*eWMAState
+}
+
+type eWMAState struct {
+	seen     int
+	mean     float64
+	variance float64
+}
+
+func (d *eWMADetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	var err error
+	if d.alpha, err = configFloat(conf, "alpha", defaultEWMAAlpha); err != nil {
+		return err
+	}
+	if d.alpha <= 0 || d.alpha > 1 {
+		return errors.New("'alpha' must be > 0 and <= 1")
+	}
+	if d.k, err = configFloat(conf, "k", defaultEWMAK); err != nil {
+		return err
+	}
+	if d.k <= 0 {
+		return errors.New("'k' must be > 0")
+	}
+	if d.warmUp, err = configInt(conf, "warm_up", defaultEWMAWarmUp); err != nil {
+		return err
+	}
+	if d.warmUp < 1 {
+		return errors.New("'warm_up' must be >= 1")
+	}
+	d.series = map[string]*eWMAState{}
+	return nil
+}
+
+func (d *eWMADetector) Detect(win window, out chan ruling) {
+	if win.Missing() {
+		out <- detectRuling(win, false, 0.0, 0.0)
+		return
+	}
+
+	state, ok := d.series[win.Series]
+	if !ok {
+		state = &eWMAState{mean: win.Value}
+		d.series[win.Series] = state
+	}
+
+	anomalous, zScore, deviation := false, 0.0, 0.0
+	if state.seen >= d.warmUp {
+		deviation = win.Value - state.mean
+		zScore = deviation / stdDevFloor(math.Sqrt(state.variance), state.mean)
+		anomalous = math.Abs(zScore) > d.k
+	}
+
+	// Anomalous windows are folded in too, so that a lasting change in level
+	// stops being flagged once the mean has caught up with it.
+	diff := win.Value - state.mean
+	incr := d.alpha * diff
+	state.mean += incr
+	state.variance = (1 - d.alpha) * (state.variance + diff*incr)
+	state.seen++
+
+	out <- detectRuling(win, anomalous, zScore, deviation)
+}
+
+func (d *eWMADetector) Evict(series string) {
+	delete(d.series, series)
+}
+
+// stdDevFloor keeps a standard deviation from being zero, so that any change
+// in a perfectly flat series gives a large, but finite, score.
+func stdDevFloor(stdDev, level float64) float64 {
+	floor := 1e-9 * math.Max(1.0, math.Abs(level))
+	if stdDev < floor {
+		return floor
+	}
+	return stdDev
+}
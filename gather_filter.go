@@ -13,7 +13,7 @@ import (
 
 var (
 	defaultAggregator = "Sum"
-	defaultValueField = "normed"
+	defaultValueField = "Normed"
 	aggFunctions      = map[string]func(stats.Float64Data) (float64, error){
 		"Sum":      stats.Sum,
 		"Mean":     stats.Mean,
@@ -47,7 +47,8 @@ type GatherConfig struct {
 	Statistic string
 
 	// ValueField identifies the field of each anomaly that should be used to
-	// generate their parent span's statistic.
+	// generate their parent span's statistic, e.g. "Normed" or
+	// "Anomalousness". Defaults to "Normed".
 	ValueField string `toml:"value_field"`
 
 	// LastDate is the date and time of the final piece of data you're
@@ -83,6 +84,13 @@ func (f *gatherFilter) Init(config interface{}) error {
 		return nil
 	}
 
+	if f.GatherConfig.ValueField == "" {
+		f.GatherConfig.ValueField = defaultValueField
+	}
+	if field, ok := reflect.TypeOf(ruling{}).FieldByName(f.GatherConfig.ValueField); !ok || field.Type.Kind() != reflect.Float64 {
+		return errors.New("'value_field' must name a numeric field of rulings.")
+	}
+
 	if f.GatherConfig.SpanWidth <= 0 {
 		return errors.New("'span_width' must be greater than zero.")
 	}
@@ -122,6 +130,17 @@ func (f *gatherFilter) Connect(in chan ruling) chan span {
 
 			f.spanCache.Lock()
 
+			// The series has been evicted, so wrap up its span now; we won't be
+			// hearing from it again.
+			if ruling.Window.Evict {
+				if s, ok := f.spanCache.spans[thisSeries]; ok {
+					f.FlushSpan(s, out)
+				}
+				delete(f.spanCache.nows, thisSeries)
+				f.spanCache.Unlock()
+				continue
+			}
+
 			// Update the time for the current series.
 			now := ruling.Window.End
 			f.spanCache.nows[thisSeries] = now
@@ -148,9 +167,11 @@ func (f *gatherFilter) Connect(in chan ruling) chan span {
 						f.FlushSpan(s, out)
 						s = &span{
 							Series:      thisSeries,
+							Resolution:  ruling.Window.Resolution,
 							Values:      []float64{value},
 							Start:       ruling.Window.Start,
 							End:         ruling.Window.End,
+							SeriesKey:   ruling.Window.SeriesKey,
 							Passthrough: ruling.Window.Passthrough,
 						}
 						f.spanCache.spans[thisSeries] = s
@@ -168,9 +189,11 @@ func (f *gatherFilter) Connect(in chan ruling) chan span {
 				// This ruling is anomalous, so start a new span.
 				s = &span{
 					Series:      thisSeries,
+					Resolution:  ruling.Window.Resolution,
 					Values:      []float64{value},
 					Start:       ruling.Window.Start,
 					End:         ruling.Window.End,
+					SeriesKey:   ruling.Window.SeriesKey,
 					Passthrough: ruling.Window.Passthrough,
 				}
 				f.spanCache.spans[thisSeries] = s
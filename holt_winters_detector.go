@@ -0,0 +1,273 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+const (
+	defaultHoltWintersSeasonality = "Additive"
+	defaultHoltWintersK           = 3.0
+)
+
+var (
+	holtWintersSeasonalities = []string{"Additive", "Multiplicative"}
+	// holtWintersGrid holds the smoothing parameters tried when fitting.
+	holtWintersGrid = []float64{0.05, 0.15, 0.25, 0.35, 0.45, 0.55, 0.65, 0.75, 0.85, 0.95}
+)
+
+func init() {
+	RegisterDetector("HoltWinters", func() Detector {
+		return new(holtWintersDetector)
+	})
+}
+
+// holtWintersDetector forecasts each window with triple exponential
+// smoothing, and rules it anomalous when it falls outside a prediction
+// interval of `k` (default 3) standard deviations of the series' recent
+// one-step forecast errors. It's configured with `season_length`, the number
+// of windows in a season (required), and `seasonality`, either "Additive"
+// (default) or "Multiplicative". The smoothing parameters `alpha`, `beta` and
+// `gamma` may be given; any that aren't are fitted to each series' first two
+// seasons by minimizing the squared one-step forecast error. Those first two
+// seasons are never ruled anomalous. After that, each window updates the
+// series' level, trend and seasonal components in turn. Anomalousness is the
+// window's forecast error in standard deviations, and Normed the forecast
+// error itself.
+type holtWintersDetector struct {
+	seasonLength   int
+	multiplicative bool
+	k              float64
+	alphas         []float64
+	betas          []float64
+	gammas         []float64
+	series         map[string]*holtWintersState
+}
+
+type holtWintersState struct {
+	// history holds the values seen while the series is warming up.
+	history        []float64
+	ready          bool
+	multiplicative bool
+	alpha          float64
+	beta           float64
+	gamma          float64
+	level          float64
+	trend          float64
+	seasonal       []float64
+	t              int
+	variance       float64
+}
+
+func (d *holtWintersDetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	var err error
+	if _, ok := conf["season_length"]; !ok {
+		return errors.New("Must provide 'season_length'")
+	}
+	if d.seasonLength, err = configInt(conf, "season_length", 0); err != nil {
+		return err
+	}
+	if d.seasonLength < 2 {
+		return errors.New("'season_length' must be >= 2")
+	}
+
+	seasonality, ok := conf["seasonality"]
+	if !ok {
+		seasonality = defaultHoltWintersSeasonality
+	}
+	seasonalityStr, ok := seasonality.(string)
+	if !ok || !seasonalityIsKnown(seasonalityStr) {
+		return errors.New("Unknown 'seasonality'.")
+	}
+	d.multiplicative = seasonalityStr == "Multiplicative"
+
+	if d.k, err = configFloat(conf, "k", defaultHoltWintersK); err != nil {
+		return err
+	}
+	if d.k <= 0 {
+		return errors.New("'k' must be > 0")
+	}
+
+	if d.alphas, err = smoothingCandidates(conf, "alpha"); err != nil {
+		return err
+	}
+	if d.betas, err = smoothingCandidates(conf, "beta"); err != nil {
+		return err
+	}
+	if d.gammas, err = smoothingCandidates(conf, "gamma"); err != nil {
+		return err
+	}
+	d.series = map[string]*holtWintersState{}
+	return nil
+}
+
+// smoothingCandidates returns the configured value of the named smoothing
+// parameter, or the values to try when fitting it if none is configured.
+func smoothingCandidates(conf pipeline.PluginConfig, name string) ([]float64, error) {
+	if _, ok := conf[name]; !ok {
+		return holtWintersGrid, nil
+	}
+	val, err := configFloat(conf, name, 0.0)
+	if err != nil {
+		return nil, err
+	}
+	if val < 0 || val > 1 {
+		return nil, errors.New("'" + name + "' must be >= 0 and <= 1")
+	}
+	return []float64{val}, nil
+}
+
+func (d *holtWintersDetector) Detect(win window, out chan ruling) {
+	state, ok := d.series[win.Series]
+	if !ok {
+		state = &holtWintersState{multiplicative: d.multiplicative}
+		d.series[win.Series] = state
+	}
+
+	if !state.ready {
+		// Missing windows stand in for the last value seen, so that the seasons
+		// stay lined up.
+		switch {
+		case !win.Missing():
+			state.history = append(state.history, win.Value)
+		case len(state.history) > 0:
+			state.history = append(state.history, state.history[len(state.history)-1])
+		}
+		if len(state.history) == 2*d.seasonLength {
+			d.fit(state)
+		}
+		out <- detectRuling(win, false, 0.0, 0.0)
+		return
+	}
+
+	forecast := state.forecast()
+	if win.Missing() {
+		// Keep the seasons lined up by carrying on as if the forecast had come
+		// true.
+		state.update(forecast)
+		out <- detectRuling(win, false, 0.0, 0.0)
+		return
+	}
+
+	stdDev := stdDevFloor(math.Sqrt(state.variance), forecast)
+	residual := win.Value - forecast
+	zScore := residual / stdDev
+	anomalous := math.Abs(zScore) > d.k
+
+	// Anomalous values are clipped to the edge of the prediction interval
+	// before being smoothed in, so that a single spike doesn't distort the
+	// next season's forecasts, while a lasting change is still caught up with.
+	value := win.Value
+	if anomalous {
+		value = forecast + math.Copysign(d.k*stdDev, residual)
+		residual = value - forecast
+	}
+	state.update(value)
+	weight := 1.0 / float64(d.seasonLength)
+	state.variance = (1-weight)*state.variance + weight*residual*residual
+
+	out <- detectRuling(win, anomalous, zScore, win.Value-forecast)
+}
+
+func (d *holtWintersDetector) Evict(series string) {
+	delete(d.series, series)
+}
+
+// fit picks the smoothing parameters that best forecast the series' warm-up
+// history, and leaves state ready to forecast the window after it.
+func (d *holtWintersDetector) fit(state *holtWintersState) {
+	best := math.Inf(1)
+	var bestState *holtWintersState
+	for _, alpha := range d.alphas {
+		for _, beta := range d.betas {
+			for _, gamma := range d.gammas {
+				candidate := &holtWintersState{
+					multiplicative: d.multiplicative,
+					alpha:          alpha,
+					beta:           beta,
+					gamma:          gamma,
+				}
+				sse := candidate.run(state.history, d.seasonLength)
+				if bestState == nil || sse < best {
+					best, bestState = sse, candidate
+				}
+			}
+		}
+	}
+	*state = *bestState
+	state.variance = best / float64(2*d.seasonLength)
+	state.ready = true
+}
+
+// run initializes the state from the first two seasons of values, then
+// smooths in every value, returning the sum of the squared one-step forecast
+// errors.
+func (s *holtWintersState) run(values []float64, seasonLength int) float64 {
+	first := sumValues(values[:seasonLength]) / float64(seasonLength)
+	second := sumValues(values[seasonLength:2*seasonLength]) / float64(seasonLength)
+	s.level = first
+	s.trend = (second - first) / float64(seasonLength)
+	s.seasonal = make([]float64, seasonLength)
+	for i := range s.seasonal {
+		if s.multiplicative {
+			s.seasonal[i] = values[i] / nonZero(first)
+		} else {
+			s.seasonal[i] = values[i] - first
+		}
+	}
+	// Move the level back from the middle of the first season to its start.
+	s.level -= s.trend * float64(seasonLength-1) / 2
+	s.t = 0
+
+	sse := 0.0
+	for _, value := range values {
+		err := value - s.forecast()
+		sse += err * err
+		s.update(value)
+	}
+	return sse
+}
+
+func (s *holtWintersState) forecast() float64 {
+	seasonal := s.seasonal[s.t%len(s.seasonal)]
+	if s.multiplicative {
+		return (s.level + s.trend) * seasonal
+	}
+	return s.level + s.trend + seasonal
+}
+
+func (s *holtWintersState) update(value float64) {
+	i := s.t % len(s.seasonal)
+	seasonal := s.seasonal[i]
+	level := s.level
+	if s.multiplicative {
+		s.level = s.alpha*value/nonZero(seasonal) + (1-s.alpha)*(level+s.trend)
+		s.seasonal[i] = s.gamma*value/nonZero(s.level) + (1-s.gamma)*seasonal
+	} else {
+		s.level = s.alpha*(value-seasonal) + (1-s.alpha)*(level+s.trend)
+		s.seasonal[i] = s.gamma*(value-s.level) + (1-s.gamma)*seasonal
+	}
+	s.trend = s.beta*(s.level-level) + (1-s.beta)*s.trend
+	s.t++
+}
+
+// nonZero keeps a divisor from being zero.
+func nonZero(val float64) float64 {
+	if math.Abs(val) < 1e-9 {
+		return math.Copysign(1e-9, val)
+	}
+	return val
+}
+
+func seasonalityIsKnown(seasonality string) bool {
+	for _, v := range holtWintersSeasonalities {
+		if v == seasonality {
+			return true
+		}
+	}
+	return false
+}
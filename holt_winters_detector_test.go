@@ -0,0 +1,45 @@
+package hekaanom
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+func TestHoltWintersDetectsSeasonalSpikes(t *testing.T) {
+	// Six seasons of a daily cycle of 24 windows, with a little noise.
+	seasons := func() []float64 {
+		values := make([]float64, 6*24)
+		for i := range values {
+			values[i] = 100 + 20*float64(i%24%12) + float64(i%5)
+		}
+		return values
+	}
+	spiked := func(at int, by float64) []float64 {
+		values := seasons()
+		values[at] += by
+		return values
+	}
+	tests := []struct {
+		name        string
+		seasonality string
+		values      []float64
+		want        []int
+	}{
+		{"clean", "Additive", seasons(), nil},
+		{"spike", "Additive", spiked(100, 150), []int{100}},
+		{"dip", "Additive", spiked(120, -150), []int{120}},
+		{"multiplicative", "Multiplicative", spiked(100, 150), []int{100}},
+	}
+	for _, test := range tests {
+		d := new(holtWintersDetector)
+		conf := pipeline.PluginConfig{"season_length": int64(24), "seasonality": test.seasonality}
+		if err := d.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+		if got := anomalousAt(detectValues(t, d, test.values)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: anomalous at %v, want %v", test.name, got, test.want)
+		}
+	}
+}
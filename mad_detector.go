@@ -0,0 +1,82 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/montanaflynn/stats"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+const (
+	defaultMADLookback = 30
+	defaultMADK        = 3.5
+
+	// madScale makes the median absolute deviation of normally distributed
+	// data an estimate of its standard deviation.
+	madScale = 1.4826
+)
+
+func init() {
+	RegisterDetector("MAD", func() Detector {
+		return new(mADDetector)
+	})
+}
+
+// mADDetector rules a window anomalous when its robust z-score, taken against
+// the median and median absolute deviation of the series' previous `lookback`
+// windows (default 30), is more than `k` (default 3.5). Unlike a mean and
+// standard deviation, these aren't dragged along by the very spikes being
+// looked for. Anomalousness is the robust z-score, and Normed the window's
+// difference from the median. No window is ruled anomalous until a full
+// lookback's worth of windows has been seen.
+type mADDetector struct {
+	lookback int
+	k        float64
+	series   map[string][]float64
+}
+
+func (d *mADDetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	var err error
+	if d.lookback, err = configInt(conf, "lookback", defaultMADLookback); err != nil {
+		return err
+	}
+	if d.lookback < 3 {
+		return errors.New("'lookback' must be >= 3")
+	}
+	if d.k, err = configFloat(conf, "k", defaultMADK); err != nil {
+		return err
+	}
+	if d.k <= 0 {
+		return errors.New("'k' must be > 0")
+	}
+	d.series = map[string][]float64{}
+	return nil
+}
+
+func (d *mADDetector) Detect(win window, out chan ruling) {
+	if win.Missing() {
+		out <- detectRuling(win, false, 0.0, 0.0)
+		return
+	}
+
+	history := d.series[win.Series]
+	anomalous, zScore, deviation := false, 0.0, 0.0
+	if len(history) == d.lookback {
+		median, _ := stats.Median(history)
+		mad, _ := stats.MedianAbsoluteDeviation(history)
+		deviation = win.Value - median
+		zScore = deviation / stdDevFloor(madScale*mad, median)
+		anomalous = math.Abs(zScore) > d.k
+		history = history[1:]
+	}
+	d.series[win.Series] = append(history, win.Value)
+
+	out <- detectRuling(win, anomalous, zScore, deviation)
+}
+
+func (d *mADDetector) Evict(series string) {
+	delete(d.series, series)
+}
@@ -0,0 +1,240 @@
+package hekaanom
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+var (
+	defaultValueReduction = "First"
+	valueReductions       = map[string]func([]float64) float64{
+		"First": func(vals []float64) float64 { return vals[0] },
+		"Last":  func(vals []float64) float64 { return vals[len(vals)-1] },
+		"Sum":   sumValues,
+		"Mean": func(vals []float64) float64 {
+			return sumValues(vals) / float64(len(vals))
+		},
+		"Min": func(vals []float64) float64 {
+			min := vals[0]
+			for _, val := range vals[1:] {
+				if val < min {
+					min = val
+				}
+			}
+			return min
+		},
+		"Max": func(vals []float64) float64 {
+			max := vals[0]
+			for _, val := range vals[1:] {
+				if val > max {
+					max = val
+				}
+			}
+			return max
+		},
+	}
+)
+
+// messageField finds the named field in msg. As in Heka's message matcher,
+// "Type", "Logger", "Hostname", "Severity", "EnvVersion" and "Pid" refer to
+// the message's headers, and "Fields[name]" to a dynamic field. "Payload"
+// refers to the length of the payload in bytes. Any other name is taken to be
+// that of a dynamic field.
+func messageField(msg *message.Message, name string) *message.Field {
+	var value interface{}
+	switch name {
+	case "Type":
+		value = msg.GetType()
+	case "Logger":
+		value = msg.GetLogger()
+	case "Hostname":
+		value = msg.GetHostname()
+	case "Severity":
+		value = int64(msg.GetSeverity())
+	case "EnvVersion":
+		value = msg.GetEnvVersion()
+	case "Pid":
+		value = int64(msg.GetPid())
+	case "Payload":
+		value = int64(len(msg.GetPayload()))
+	default:
+		return msg.FindFirstField(fieldName(name))
+	}
+	field, err := message.NewField(name, value, "")
+	if err != nil {
+		return nil
+	}
+	return field
+}
+
+// fieldName strips the "Fields[...]" around a dynamic field's name, if it's
+// given that way.
+func fieldName(name string) string {
+	if strings.HasPrefix(name, "Fields[") && strings.HasSuffix(name, "]") {
+		return name[len("Fields[") : len(name)-1]
+	}
+	return name
+}
+
+// messageFloat finds the named field in msg and reduces its values to
+// a single number.
+func messageFloat(msg *message.Message, name string, reduce func([]float64) float64) (float64, error) {
+	field := messageField(msg, name)
+	if field == nil {
+		return 0.0, fmt.Errorf("Message does not contain '%s' field", name)
+	}
+	vals, err := fieldFloats(field)
+	if err != nil {
+		return 0.0, fmt.Errorf("Could not read '%s' field: %s", name, err)
+	}
+	if len(vals) == 0 {
+		return 0.0, fmt.Errorf("'%s' field has no values", name)
+	}
+	return reduce(vals), nil
+}
+
+// fieldFloats converts every value of a field of any of Heka's field types to
+// a float. Booleans become 1 or 0, and strings and bytes are parsed.
+func fieldFloats(field *message.Field) ([]float64, error) {
+	switch field.GetValueType() {
+	case message.Field_DOUBLE:
+		return field.GetValueDouble(), nil
+	case message.Field_INTEGER:
+		ints := field.GetValueInteger()
+		vals := make([]float64, len(ints))
+		for i, val := range ints {
+			vals[i] = float64(val)
+		}
+		return vals, nil
+	case message.Field_BOOL:
+		bools := field.GetValueBool()
+		vals := make([]float64, len(bools))
+		for i, val := range bools {
+			if val {
+				vals[i] = 1.0
+			}
+		}
+		return vals, nil
+	case message.Field_STRING:
+		return parseFloats(field.GetValueString())
+	case message.Field_BYTES:
+		strs := make([]string, len(field.GetValueBytes()))
+		for i, val := range field.GetValueBytes() {
+			strs[i] = string(val)
+		}
+		return parseFloats(strs)
+	}
+	return nil, errors.New("unknown field type")
+}
+
+// messageTime finds the named field in msg and reads the time it holds in the
+// given format: "RFC3339", "UnixSeconds", "UnixMillis", "UnixNanos", or a Go
+// time layout.
+func messageTime(msg *message.Message, name, format string) (time.Time, error) {
+	field := messageField(msg, name)
+	if field == nil {
+		return time.Time{}, fmt.Errorf("Message does not contain '%s' field", name)
+	}
+
+	var unit time.Duration
+	switch format {
+	case "UnixSeconds":
+		unit = time.Second
+	case "UnixMillis":
+		unit = time.Millisecond
+	case "UnixNanos":
+		unit = time.Nanosecond
+	}
+
+	if unit == 0 {
+		layout := format
+		if format == "RFC3339" {
+			layout = time.RFC3339Nano
+		}
+		strs := field.GetValueString()
+		if len(strs) == 0 {
+			return time.Time{}, fmt.Errorf("'%s' field is not a string", name)
+		}
+		return time.Parse(layout, strs[0])
+	}
+
+	// Integers are read as-is so that nanoseconds don't lose precision.
+	var ints []int64
+	switch field.GetValueType() {
+	case message.Field_INTEGER:
+		ints = field.GetValueInteger()
+	case message.Field_STRING:
+		for _, str := range field.GetValueString() {
+			val, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				break
+			}
+			ints = append(ints, val)
+		}
+	}
+	if len(ints) > 0 {
+		return time.Unix(0, ints[0]*int64(unit)), nil
+	}
+
+	vals, err := fieldFloats(field)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Could not read '%s' field: %s", name, err)
+	}
+	if len(vals) == 0 || math.IsNaN(vals[0]) || math.IsInf(vals[0], 0) {
+		return time.Time{}, fmt.Errorf("'%s' field has no usable values", name)
+	}
+	return time.Unix(0, int64(vals[0]*float64(unit))), nil
+}
+
+// fieldStrings formats every value of a field of any of Heka's field types as
+// a string.
+func fieldStrings(field *message.Field) []string {
+	var strs []string
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		strs = field.GetValueString()
+	case message.Field_BYTES:
+		for _, val := range field.GetValueBytes() {
+			strs = append(strs, string(val))
+		}
+	case message.Field_INTEGER:
+		for _, val := range field.GetValueInteger() {
+			strs = append(strs, strconv.FormatInt(val, 10))
+		}
+	case message.Field_DOUBLE:
+		for _, val := range field.GetValueDouble() {
+			strs = append(strs, strconv.FormatFloat(val, 'g', -1, 64))
+		}
+	case message.Field_BOOL:
+		for _, val := range field.GetValueBool() {
+			strs = append(strs, strconv.FormatBool(val))
+		}
+	}
+	return strs
+}
+
+func parseFloats(strs []string) ([]float64, error) {
+	vals := make([]float64, len(strs))
+	for i, str := range strs {
+		val, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
+
+func sumValues(vals []float64) float64 {
+	sum := 0.0
+	for _, val := range vals {
+		sum += val
+	}
+	return sum
+}
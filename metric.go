@@ -1,14 +1,52 @@
 package hekaanom
 
 import (
+	"errors"
 	"time"
 
 	"github.com/mozilla-services/heka/message"
 )
 
 type metric struct {
-	Timestamp   time.Time
-	Series      string
-	Value       float64
+	Timestamp time.Time
+	Series    string
+	SeriesKey seriesKey
+	Value     float64
+	// The fraction of the underlying events that this metric was sampled
+	// from, e.g. 0.1 if it stands in for ten events. Zero means unsampled.
+	SampleRate  float64
 	Passthrough []*message.Field
+	// Evict marks this as a notice that Series has been evicted, rather than
+	// as an actual metric.
+	Evict bool
+}
+
+// Weight returns how many events this metric stands in for.
+func (m metric) Weight() float64 {
+	if m.SampleRate <= 0 || m.SampleRate > 1 {
+		return 1.0
+	}
+	return 1.0 / m.SampleRate
+}
+
+func (m metric) FillMessage(msg *message.Message) error {
+	series, err := message.NewField("series", m.Series, "")
+	if err != nil {
+		return errors.New("Could not create 'series' field")
+	}
+	value, err := message.NewField("value", m.Value, "count")
+	if err != nil {
+		return errors.New("Could not create 'value' field")
+	}
+	msg.SetTimestamp(m.Timestamp.UnixNano())
+	msg.AddField(series)
+	msg.AddField(value)
+	if err = m.SeriesKey.FillMessage(msg); err != nil {
+		return err
+	}
+
+	for _, field := range m.Passthrough {
+		msg.AddField(field)
+	}
+	return nil
 }
@@ -8,6 +8,12 @@ import (
 	"github.com/mozilla-services/heka/pipeline"
 )
 
+func init() {
+	RegisterDetector("RPCA", func() Detector {
+		return new(rPCADetector)
+	})
+}
+
 type rPCADetector struct {
 	majorFreq int
 	minorFreq int
@@ -69,28 +75,23 @@ func (d *rPCADetector) Detect(win window, out chan ruling) {
 		d.series[win.Series] = series[1:]
 	}
 
-	values := make([]float64, len(d.series[win.Series]))
-	for i, thisWin := range d.series[win.Series] {
-		values[i] = thisWin.Value
-	}
+	values := windowValues(d.series[win.Series])
 
 	anoms := rpca.FindAnomalies(values, rpca.Frequency(d.majorFreq), rpca.AutoDiff(d.autoDiff))
 
 	if sendAll {
 		for i := range anoms.Positions {
-			out <- ruling{
-				Window:        *series[i],
-				Anomalous:     anoms.Positions[i],
-				Anomalousness: anoms.Values[i],
-				Normed:        anoms.NormedValues[i],
-				Passthrough:   series[i].Passthrough,
-			}
+			out <- detectRuling(*series[i], anoms.Positions[i], anoms.Values[i], anoms.NormedValues[i])
 		}
 	} else {
 		// Just send the latest anomaly
 		i := len(anoms.Values) - 1
 		anomalous, anomalousness := anoms.Positions[i], anoms.Values[i]
 		normed := anoms.NormedValues[i]
-		out <- ruling{win, anomalous, anomalousness, normed, win.Passthrough}
+		out <- detectRuling(win, anomalous, anomalousness, normed)
 	}
 }
+
+func (d *rPCADetector) Evict(series string) {
+	delete(d.series, series)
+}
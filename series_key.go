@@ -0,0 +1,101 @@
+package hekaanom
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	seriesSeparator      = '|'
+	seriesValueSeparator = ','
+	seriesEscape         = '\\'
+)
+
+// seriesKey is the structured form of a series code: the value of each of the
+// series fields, in order.
+type seriesKey []seriesKeyPart
+
+type seriesKeyPart struct {
+	Name string
+	// The field's value as it appears in the series code: its values joined
+	// by ',', with any ',' or '\' in them escaped by a '\'.
+	Value string
+	// The field's unescaped values, if it was present.
+	Values []string
+}
+
+// String joins the values of the key with '|', escaping any '|' or '\' that
+// appear in the values themselves.
+func (k seriesKey) String() string {
+	var series bytes.Buffer
+	for i, part := range k {
+		if i > 0 {
+			series.WriteRune(seriesSeparator)
+		}
+		series.WriteString(escapeSeriesValue(part.Value, seriesSeparator))
+	}
+	return series.String()
+}
+
+// Format fills in a template such as "{page} in {country}" with the values of
+// the key.
+func (k seriesKey) Format(template string) string {
+	replacements := make([]string, 0, 2*len(k))
+	for _, part := range k {
+		replacements = append(replacements, "{"+part.Name+"}", part.Value)
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// FillMessage adds a "series.<name>" field to m for every part of the key, so
+// that the series' individual values can be read without parsing the series
+// code. Fields with more than one value keep each of them.
+func (k seriesKey) FillMessage(m *message.Message) error {
+	for _, part := range k {
+		values := part.Values
+		if len(values) == 0 {
+			values = []string{part.Value}
+		}
+		field, err := message.NewField("series."+part.Name, values[0], "")
+		if err != nil {
+			return errors.New("Could not create 'series." + part.Name + "' field")
+		}
+		for _, value := range values[1:] {
+			if err := field.AddValue(value); err != nil {
+				return errors.New("Could not create 'series." + part.Name + "' field")
+			}
+		}
+		m.AddField(field)
+	}
+	return nil
+}
+
+// setValues sets the key part to the values of its field. Any ',' or '\' in
+// the values is escaped, even if there's only one, so that a single value of
+// "a,b" can't be mistaken for the two values "a" and "b".
+func (p *seriesKeyPart) setValues(vals []string) {
+	escaped := make([]string, len(vals))
+	for i, val := range vals {
+		escaped[i] = escapeSeriesValue(val, seriesValueSeparator)
+	}
+	p.Value, p.Values = strings.Join(escaped, string(seriesValueSeparator)), vals
+}
+
+// escapeSeriesValue escapes any occurrences of the given separator, and of the
+// escape character itself, in value.
+func escapeSeriesValue(value string, separator rune) string {
+	if !strings.ContainsAny(value, string([]rune{separator, seriesEscape})) {
+		return value
+	}
+	var escaped bytes.Buffer
+	for _, r := range value {
+		if r == separator || r == seriesEscape {
+			escaped.WriteRune(seriesEscape)
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
@@ -0,0 +1,79 @@
+package hekaanom
+
+import (
+	"container/list"
+	"time"
+)
+
+// seriesLRU keeps track of the series currently held in memory, in order of
+// when they last received a metric.
+type seriesLRU struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+type seriesEntry struct {
+	series   string
+	lastSeen time.Time
+}
+
+func newSeriesLRU() *seriesLRU {
+	return &seriesLRU{
+		order: list.New(),
+		elems: map[string]*list.Element{},
+	}
+}
+
+func (c *seriesLRU) Len() int {
+	return c.order.Len()
+}
+
+func (c *seriesLRU) Contains(series string) bool {
+	_, ok := c.elems[series]
+	return ok
+}
+
+// Touch marks series as having received a metric at the given time, adding it
+// if it isn't already being tracked.
+func (c *seriesLRU) Touch(series string, seen time.Time) {
+	if elem, ok := c.elems[series]; ok {
+		entry := elem.Value.(*seriesEntry)
+		if seen.After(entry.lastSeen) {
+			entry.lastSeen = seen
+		}
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.elems[series] = c.order.PushFront(&seriesEntry{series, seen})
+}
+
+// Oldest returns the least recently seen series.
+func (c *seriesLRU) Oldest() (string, bool) {
+	elem := c.order.Back()
+	if elem == nil {
+		return "", false
+	}
+	return elem.Value.(*seriesEntry).series, true
+}
+
+func (c *seriesLRU) Remove(series string) {
+	if elem, ok := c.elems[series]; ok {
+		c.order.Remove(elem)
+		delete(c.elems, series)
+	}
+}
+
+// IdleSince returns the least recently seen series that haven't received
+// a metric since the given time. It stops at the first series that has, so
+// it's cheap to call for every metric.
+func (c *seriesLRU) IdleSince(since time.Time) []string {
+	var idle []string
+	for elem := c.order.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*seriesEntry)
+		if !entry.lastSeen.Before(since) {
+			break
+		}
+		idle = append(idle, entry.series)
+	}
+	return idle
+}
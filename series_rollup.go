@@ -0,0 +1,99 @@
+package hekaanom
+
+import (
+	"errors"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+var (
+	defaultSeriesRollup = "None"
+	seriesRollups       = []string{"None", "Prefixes", "Subsets"}
+)
+
+// rollupMasks returns, for each roll-up of numFields series fields, which of
+// the fields it keeps. The full series itself isn't included.
+func rollupMasks(rollup string, numFields int) [][]bool {
+	var masks [][]bool
+	switch rollup {
+	case "Prefixes":
+		for kept := numFields - 1; kept >= 0; kept-- {
+			mask := make([]bool, numFields)
+			for i := 0; i < kept; i++ {
+				mask[i] = true
+			}
+			masks = append(masks, mask)
+		}
+	case "Subsets":
+		full := 1<<uint(numFields) - 1
+		for set := full - 1; set >= 0; set-- {
+			mask := make([]bool, numFields)
+			for i := range mask {
+				mask[i] = set&(1<<uint(i)) != 0
+			}
+			masks = append(masks, mask)
+		}
+	}
+	return masks
+}
+
+// rollupMetrics returns a copy of m for each of its series' roll-ups. The
+// values of the fields a roll-up leaves out are replaced by "**all**".
+func (f *AnomalyFilter) rollupMetrics(m metric) ([]metric, error) {
+	metrics := make([]metric, 0, len(f.rollupMasks))
+	for _, mask := range f.rollupMasks {
+		rollup := m
+		rollup.SeriesKey = make(seriesKey, len(m.SeriesKey))
+		kept := map[string]bool{}
+		level := 0
+		for i, part := range m.SeriesKey {
+			if mask[i] {
+				kept[part.Name] = true
+				level++
+			} else {
+				part.Value, part.Values = defaultMessageSeries, nil
+			}
+			rollup.SeriesKey[i] = part
+		}
+
+		switch {
+		case level == 0:
+			rollup.Series = defaultMessageSeries
+		case f.AnomalyConfig.SeriesTemplate != "":
+			rollup.Series = rollup.SeriesKey.Format(f.AnomalyConfig.SeriesTemplate)
+		default:
+			rollup.Series = rollup.SeriesKey.String()
+		}
+
+		rollup.Passthrough = nil
+		for _, field := range m.Passthrough {
+			if kept[field.GetName()] {
+				rollup.Passthrough = append(rollup.Passthrough, field)
+			}
+		}
+		levelField, err := seriesLevelField(level)
+		if err != nil {
+			return nil, err
+		}
+		rollup.Passthrough = append(rollup.Passthrough, levelField)
+		metrics = append(metrics, rollup)
+	}
+	return metrics, nil
+}
+
+func seriesLevelField(level int) (*message.Field, error) {
+	field, err := message.NewField("series_level", int64(level), "count")
+	if err != nil {
+		return nil, errors.New("Could not create 'series_level' field")
+	}
+	return field, nil
+}
+
+func rollupIsKnown(rollup string) bool {
+	for _, v := range seriesRollups {
+		if v == rollup {
+			return true
+		}
+	}
+	return false
+}
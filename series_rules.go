@@ -0,0 +1,103 @@
+package hekaanom
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var errSeriesExcluded = errors.New("Series excluded by 'series_rules'")
+
+type SeriesRuleConfig struct {
+	// The name of the series field whose values this rule applies to. If left
+	// unset, the rule applies to the values of every series field.
+	Field string `toml:"field"`
+
+	// Lowercase the value.
+	Lowercase bool `toml:"lowercase"`
+
+	// A regular expression whose matches in the value are replaced with
+	// Replacement, e.g. a Pattern of "\\?.*$" and an empty Replacement strips
+	// query strings from URLs. Replacement may refer to submatches as "$1".
+	Pattern     string `toml:"pattern"`
+	Replacement string `toml:"replacement"`
+
+	// A regular expression that the value must match, or the message is
+	// dropped before windowing. A message without the field is dropped too.
+	Include string `toml:"include"`
+
+	// A regular expression that the value must not match, or the message is
+	// dropped before windowing.
+	Exclude string `toml:"exclude"`
+}
+
+// seriesRule is a compiled SeriesRuleConfig.
+type seriesRule struct {
+	*SeriesRuleConfig
+	pattern *regexp.Regexp
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+func newSeriesRule(conf *SeriesRuleConfig) (*seriesRule, error) {
+	rule := &seriesRule{SeriesRuleConfig: conf}
+	var err error
+	if conf.Pattern != "" {
+		if rule.pattern, err = regexp.Compile(conf.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Include != "" {
+		if rule.include, err = regexp.Compile(conf.Include); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Exclude != "" {
+		if rule.exclude, err = regexp.Compile(conf.Exclude); err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+func (r *seriesRule) appliesTo(field string) bool {
+	return r.Field == "" || fieldName(r.Field) == fieldName(field)
+}
+
+// Apply normalizes value, and reports whether the message it came from should
+// be kept.
+func (r *seriesRule) Apply(value string) (string, bool) {
+	if r.Lowercase {
+		value = strings.ToLower(value)
+	}
+	if r.pattern != nil {
+		value = r.pattern.ReplaceAllString(value, r.Replacement)
+	}
+	if r.include != nil && !r.include.MatchString(value) {
+		return value, false
+	}
+	if r.exclude != nil && r.exclude.MatchString(value) {
+		return value, false
+	}
+	return value, true
+}
+
+// applySeriesRules runs every rule that applies to field over each of its
+// values, in order. It returns false if any of them rule the message out.
+func applySeriesRules(rules []*seriesRule, field string, vals []string) ([]string, bool) {
+	for _, rule := range rules {
+		if !rule.appliesTo(field) {
+			continue
+		}
+		if len(vals) == 0 && rule.include != nil {
+			return vals, false
+		}
+		for i, val := range vals {
+			var keep bool
+			if vals[i], keep = rule.Apply(val); !keep {
+				return vals, false
+			}
+		}
+	}
+	return vals, true
+}
@@ -0,0 +1,261 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/montanaflynn/stats"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+const (
+	defaultSHESDMaxAnoms = 0.1
+	defaultSHESDAlpha    = 0.05
+)
+
+func init() {
+	RegisterDetector("SHESD", func() Detector {
+		return new(sHESDDetector)
+	})
+}
+
+// sHESDDetector implements Seasonal Hybrid ESD, as used by Twitter's
+// AnomalyDetection package. It's configured like rPCADetector: each series'
+// last `minor_frequency` windows are decomposed into a seasonal component with
+// a period of `major_frequency` windows and a median trend, and a generalized
+// ESD test, using the median and median absolute deviation, is run on what's
+// left. At most `max_anoms` (default 0.1) of the windows may be ruled
+// anomalous, at a significance level of `alpha` (default 0.05). As with
+// rPCADetector, nothing is ruled on until the first `minor_frequency` windows
+// have been seen. Anomalousness is the window's robust z-score, and Normed its
+// deviation from the series' seasonal median.
+type sHESDDetector struct {
+	majorFreq int
+	minorFreq int
+	maxAnoms  float64
+	alpha     float64
+	series    map[string][]*window
+}
+
+func (d *sHESDDetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	var err error
+	if _, ok := conf["major_frequency"]; !ok {
+		return errors.New("Must provide 'major_frequency'")
+	}
+	if d.majorFreq, err = configInt(conf, "major_frequency", 0); err != nil {
+		return err
+	}
+	if d.majorFreq <= 0 {
+		return errors.New("'major_frequency' must be > 0")
+	}
+
+	if _, ok := conf["minor_frequency"]; !ok {
+		return errors.New("Must provide 'minor_frequency'")
+	}
+	if d.minorFreq, err = configInt(conf, "minor_frequency", 0); err != nil {
+		return err
+	}
+	if d.minorFreq < 2*d.majorFreq {
+		return errors.New("'minor_frequency' must be at least twice 'major_frequency'")
+	}
+
+	if d.maxAnoms, err = configFloat(conf, "max_anoms", defaultSHESDMaxAnoms); err != nil {
+		return err
+	}
+	if d.maxAnoms <= 0 || d.maxAnoms >= 0.5 {
+		return errors.New("'max_anoms' must be > 0 and < 0.5")
+	}
+	if d.alpha, err = configFloat(conf, "alpha", defaultSHESDAlpha); err != nil {
+		return err
+	}
+	if d.alpha <= 0 || d.alpha >= 1 {
+		return errors.New("'alpha' must be > 0 and < 1")
+	}
+	d.series = map[string][]*window{}
+	return nil
+}
+
+func (d *sHESDDetector) Detect(win window, out chan ruling) {
+	d.series[win.Series] = append(d.series[win.Series], &win)
+	series := d.series[win.Series]
+
+	if len(series) < d.minorFreq {
+		return
+	}
+
+	// If this completes our window, send all the rulings we haven't been
+	// sending up to now.
+	sendAll := len(series) == d.minorFreq
+	if len(series) > d.minorFreq {
+		series = series[1:]
+		d.series[win.Series] = series
+	}
+
+	values := windowValues(series)
+
+	anomalous, scores, deviations := d.findAnomalies(values)
+	if sendAll {
+		for i := range series {
+			out <- detectRuling(*series[i], anomalous[i], scores[i], deviations[i])
+		}
+		return
+	}
+	i := len(series) - 1
+	out <- detectRuling(win, anomalous[i], scores[i], deviations[i])
+}
+
+func (d *sHESDDetector) Evict(series string) {
+	delete(d.series, series)
+}
+
+// findAnomalies runs Seasonal Hybrid ESD over values, returning which of them
+// are anomalous, along with each value's robust z-score and deviation.
+func (d *sHESDDetector) findAnomalies(values []float64) ([]bool, []float64, []float64) {
+	seasonal := seasonalComponent(values, d.majorFreq)
+	median, _ := stats.Median(values)
+	residuals := make([]float64, len(values))
+	for i, value := range values {
+		residuals[i] = value - seasonal[i] - median
+	}
+
+	center, _ := stats.Median(residuals)
+	mad, _ := stats.MedianAbsoluteDeviation(residuals)
+	scale := stdDevFloor(madScale*mad, median)
+	scores := make([]float64, len(values))
+	deviations := make([]float64, len(values))
+	for i, residual := range residuals {
+		deviations[i] = residual - center
+		scores[i] = deviations[i] / scale
+	}
+
+	return generalizedESD(residuals, d.maxAnoms, d.alpha), scores, deviations
+}
+
+// seasonalComponent estimates the seasonal part of values, as STL does with
+// a periodic seasonal window, but using medians throughout: the values are
+// detrended with a moving median one period wide, and each phase of the
+// period gets the median of its detrended values.
+func seasonalComponent(values []float64, period int) []float64 {
+	detrended := make([]float64, len(values))
+	for i := range values {
+		lo, hi := i-period/2, i+(period-1)/2+1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(values) {
+			hi = len(values)
+		}
+		trend, _ := stats.Median(values[lo:hi])
+		detrended[i] = values[i] - trend
+	}
+
+	phases := make([]float64, period)
+	for phase := range phases {
+		var cycle []float64
+		for i := phase; i < len(detrended); i += period {
+			cycle = append(cycle, detrended[i])
+		}
+		phases[phase], _ = stats.Median(cycle)
+	}
+	// The median trend, not the seasonal component, should carry the level.
+	level, _ := stats.Median(phases)
+
+	seasonal := make([]float64, len(values))
+	for i := range seasonal {
+		seasonal[i] = phases[i%period] - level
+	}
+	return seasonal
+}
+
+// generalizedESD runs Rosner's generalized extreme Studentized deviate test
+// over values, with the median and median absolute deviation standing in for
+// the mean and standard deviation, and returns which values are outliers.
+func generalizedESD(values []float64, maxAnoms, alpha float64) []bool {
+	outliers := make([]bool, len(values))
+	n := len(values)
+	maxOutliers := int(math.Floor(maxAnoms * float64(n)))
+
+	remaining := make([]int, n)
+	for i := range remaining {
+		remaining[i] = i
+	}
+	var candidates []int
+	numOutliers := 0
+	for i := 1; i <= maxOutliers; i++ {
+		data := make([]float64, len(remaining))
+		for j, k := range remaining {
+			data[j] = values[k]
+		}
+		median, _ := stats.Median(data)
+		mad, _ := stats.MedianAbsoluteDeviation(data)
+		if mad == 0 {
+			break
+		}
+
+		worst := 0
+		for j := range data {
+			if math.Abs(data[j]-median) > math.Abs(data[worst]-median) {
+				worst = j
+			}
+		}
+		score := math.Abs(data[worst]-median) / (madScale * mad)
+		candidates = append(candidates, remaining[worst])
+		remaining = append(remaining[:worst], remaining[worst+1:]...)
+
+		if score > esdCriticalValue(n-i+1, alpha) {
+			numOutliers = i
+		}
+	}
+
+	for _, i := range candidates[:numOutliers] {
+		outliers[i] = true
+	}
+	return outliers
+}
+
+// esdCriticalValue returns the generalized ESD test's critical value for the
+// most extreme of n values, at significance level alpha.
+func esdCriticalValue(n int, alpha float64) float64 {
+	left := float64(n)
+	t := studentTQuantile(alpha/left, left-2)
+	return (left - 1) * t / math.Sqrt((left-2+t*t)*left)
+}
+
+// studentTQuantile returns the t such that a Student's t-distributed variable
+// with the given degrees of freedom exceeds t in absolute value with
+// probability p, using Hill's approximation (CACM Algorithm 396).
+func studentTQuantile(p, df float64) float64 {
+	if df < 1 {
+		return math.Inf(1)
+	}
+	if df == 1 {
+		p *= math.Pi / 2
+		return math.Cos(p) / math.Sin(p)
+	}
+	if df == 2 {
+		return math.Sqrt(2/(p*(2-p)) - 2)
+	}
+
+	a := 1 / (df - 0.5)
+	b := 48 / (a * a)
+	c := ((20700*a/b-98)*a-16)*a + 96.36
+	d := ((94.5/(b+c)-3)/b + 1) * math.Sqrt(a*math.Pi/2) * df
+	x := d * p
+	y := math.Pow(x, 2/df)
+	if y > 0.05+a {
+		// Fall back on the normal quantile for large p.
+		x = math.Sqrt2 * math.Erfinv(1-p)
+		y = x * x
+		if df < 5 {
+			c += 0.3 * (df - 4.5) * (x + 0.6)
+		}
+		c = (((0.05*d*x-5)*x-7)*x-2)*x + b + c
+		y = (((((0.4*y+6.3)*y+36)*y+94.5)/c-y-3)/b + 1) * x
+		y = math.Expm1(a * y * y)
+	} else {
+		y = ((1/(((df+6)/(df*y)-0.089*d-0.822)*(df+2)*3)+0.5/(df+4))*y-1)*(df+1)/(df+2) + 1/y
+	}
+	return math.Sqrt(df * y)
+}
@@ -0,0 +1,82 @@
+package hekaanom
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStudentTQuantile(t *testing.T) {
+	// Two-sided critical values from a standard t table.
+	tests := []struct {
+		p, df, want float64
+	}{
+		{0.05, 10, 2.228},
+		{0.05, 30, 2.042},
+		{0.01, 5, 4.032},
+		{0.10, 20, 1.725},
+		{0.05, 1, 12.706},
+		{0.05, 2, 4.303},
+	}
+	for _, test := range tests {
+		if got := studentTQuantile(test.p, test.df); math.Abs(got-test.want) > 0.005 {
+			t.Errorf("studentTQuantile(%v, %v) = %.3f, want %.3f", test.p, test.df, got, test.want)
+		}
+	}
+}
+
+// rosnerData is the example from Rosner (1983), "Percentage Points for a
+// Generalized ESD Many-Outlier Procedure", as worked in the NIST/SEMATECH
+// e-Handbook of Statistical Methods, section 1.3.5.17.3.
+var rosnerData = []float64{
+	-0.25, 0.68, 0.94, 1.15, 1.20, 1.26, 1.26, 1.34, 1.38, 1.43, 1.49, 1.49,
+	1.55, 1.56, 1.58, 1.65, 1.69, 1.70, 1.76, 1.77, 1.81, 1.91, 1.94, 1.96,
+	1.99, 2.06, 2.09, 2.10, 2.14, 2.15, 2.23, 2.24, 2.26, 2.35, 2.37, 2.40,
+	2.47, 2.54, 2.62, 2.64, 2.90, 2.92, 2.92, 2.93, 3.21, 3.26, 3.30, 3.59,
+	3.68, 4.30, 4.64, 5.34, 5.42, 6.01,
+}
+
+func TestESDCriticalValuesMatchRosner(t *testing.T) {
+	// The published critical values for up to 10 outliers at alpha = 0.05.
+	want := []float64{3.158, 3.151, 3.143, 3.136, 3.128, 3.120, 3.111, 3.103, 3.094, 3.085}
+	for i, w := range want {
+		n := len(rosnerData) - i
+		if got := esdCriticalValue(n, 0.05); math.Abs(got-w) > 0.005 {
+			t.Errorf("esdCriticalValue(%d, 0.05) = %.3f, want %.3f", n, got, w)
+		}
+	}
+}
+
+func TestGeneralizedESD(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []float64
+		maxAnoms float64
+		want     []float64
+	}{
+		// Rosner finds the three largest values to be outliers. The median and
+		// MAD are less swayed by them than the mean and standard deviation, so
+		// 4.64 is caught as well.
+		{"rosner", rosnerData, 0.19, []float64{4.64, 5.34, 5.42, 6.01}},
+		{"none", []float64{1, 2, 3, 2, 1, 2, 3, 2, 1, 2, 3, 2}, 0.4, nil},
+		{"low", []float64{10, 11, 9, 10, 11, 9, 10, -20, 11, 9, 10, 11}, 0.2, []float64{-20}},
+	}
+	for _, test := range tests {
+		outliers := generalizedESD(test.values, test.maxAnoms, 0.05)
+		var got []float64
+		for i, outlier := range outliers {
+			if outlier {
+				got = append(got, test.values[i])
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got outliers %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got outliers %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
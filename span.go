@@ -13,6 +13,8 @@ type span struct {
 	End         time.Time
 	Duration    time.Duration
 	Series      string
+	SeriesKey   seriesKey
+	Resolution  string
 	Aggregation float64
 	Values      []float64
 	Score       float64
@@ -71,6 +73,11 @@ func (s span) FillMessage(m *message.Message) error {
 		return errors.New("Could not create 'series' field")
 	}
 
+	resolution, err := message.NewField("resolution", s.Resolution, "")
+	if err != nil {
+		return errors.New("Could not create 'resolution' field")
+	}
+
 	agg, err := message.NewField("aggregation", s.Aggregation, "count")
 	if err != nil {
 		return errors.New("Could not create 'aggregation' field")
@@ -96,12 +103,16 @@ func (s span) FillMessage(m *message.Message) error {
 
 	m.SetTimestamp(s.End.UnixNano())
 	m.AddField(series)
+	m.AddField(resolution)
 	m.AddField(start)
 	m.AddField(end)
 	m.AddField(durField)
 	m.AddField(agg)
 	m.AddField(score)
 	m.AddField(valuesField)
+	if err = s.SeriesKey.FillMessage(m); err != nil {
+		return err
+	}
 
 	for _, field := range s.Passthrough {
 		m.AddField(field)
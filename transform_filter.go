@@ -0,0 +1,224 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+var (
+	defaultTransform   = "None"
+	transformFunctions = []string{"None", "Log1p", "BoxCox", "ZScore"}
+)
+
+const (
+	// The range and step of the grid searched when fitting Box-Cox lambdas.
+	minBoxCoxLambda  = -2.0
+	maxBoxCoxLambda  = 2.0
+	boxCoxLambdaStep = 0.01
+	// Box-Cox is only defined for positive values, so anything smaller than
+	// this after shifting is raised to it.
+	minBoxCoxValue = 1e-9
+)
+
+type transformer interface {
+	pipeline.HasConfigStruct
+	pipeline.Plugin
+	Connect(in chan window) chan window
+}
+
+type TransformConfig struct {
+	// The function applied to the value of each window before anomalies are
+	// detected. "Log1p" takes the natural log of one plus the value (keeping
+	// the sign of negative values), "BoxCox" applies a Box-Cox power
+	// transform, and "ZScore" replaces the value with the number of standard
+	// deviations it lies from the mean of the series' earlier windows. The
+	// original value is kept on every window, ruling, and span. Defaults to
+	// "None".
+	Function string `toml:"function"`
+
+	// The Box-Cox lambda parameter. Ignored if FitWindows is set.
+	Lambda float64 `toml:"lambda"`
+
+	// If greater than zero, a Box-Cox lambda is fitted separately for each
+	// series by maximum likelihood over its first FitWindows windows. Those
+	// windows are held back until the fit is done.
+	FitWindows int `toml:"fit_windows"`
+
+	// A constant added to every value before the Box-Cox transform, which is
+	// only defined for positive values. Defaults to 1.
+	Shift float64 `toml:"shift"`
+}
+
+type transformFilter struct {
+	*TransformConfig
+	series map[string]*transformState
+}
+
+// transformState holds what's been learned so far about a single series.
+type transformState struct {
+	// For "BoxCox", the fitted lambda, and the windows waiting on the fit.
+	lambda  float64
+	fitted  bool
+	pending []window
+
+	// For "ZScore", a running count, mean, and sum of squared differences from
+	// the mean, as per Welford's algorithm.
+	count int
+	mean  float64
+	m2    float64
+}
+
+func (f *transformFilter) ConfigStruct() interface{} {
+	return &TransformConfig{
+		Function: defaultTransform,
+		Shift:    1.0,
+	}
+}
+
+func (f *transformFilter) Init(config interface{}) error {
+	f.TransformConfig = config.(*TransformConfig)
+	if f.TransformConfig.Function == "" {
+		f.TransformConfig.Function = defaultTransform
+	}
+	if !transformIsKnown(f.TransformConfig.Function) {
+		return errors.New("Unknown transform 'function'.")
+	}
+	if f.TransformConfig.FitWindows < 0 {
+		return errors.New("'fit_windows' must not be negative.")
+	}
+	f.series = map[string]*transformState{}
+	return nil
+}
+
+func (f *transformFilter) Connect(in chan window) chan window {
+	if f.TransformConfig.Function == "None" {
+		return in
+	}
+
+	out := make(chan window)
+	go func() {
+		defer close(out)
+		for win := range in {
+			if win.Evict {
+				delete(f.series, win.Series)
+				out <- win
+				continue
+			}
+
+			state, ok := f.series[win.Series]
+			if !ok {
+				state = &transformState{
+					lambda: f.TransformConfig.Lambda,
+					fitted: f.TransformConfig.FitWindows == 0,
+				}
+				f.series[win.Series] = state
+			}
+
+			if f.TransformConfig.Function == "BoxCox" && !state.fitted {
+				state.pending = append(state.pending, win)
+				if len(state.pending) < f.TransformConfig.FitWindows {
+					continue
+				}
+				state.lambda = f.fitLambda(state.pending)
+				state.fitted = true
+				for _, pending := range state.pending {
+					out <- f.transform(state, pending)
+				}
+				state.pending = nil
+				continue
+			}
+
+			out <- f.transform(state, win)
+		}
+	}()
+	return out
+}
+
+func (f *transformFilter) transform(state *transformState, win window) window {
+	if win.Missing() {
+		return win
+	}
+
+	switch f.TransformConfig.Function {
+	case "Log1p":
+		win.Value = math.Copysign(math.Log1p(math.Abs(win.Value)), win.Value)
+	case "BoxCox":
+		win.Value = boxCox(f.shifted(win.Value), state.lambda)
+	case "ZScore":
+		value := win.Value
+		if state.count > 1 && state.m2 > 0 {
+			stdDev := math.Sqrt(state.m2 / float64(state.count-1))
+			win.Value = (value - state.mean) / stdDev
+		} else {
+			win.Value = 0.0
+		}
+		state.count++
+		delta := value - state.mean
+		state.mean += delta / float64(state.count)
+		state.m2 += delta * (value - state.mean)
+	}
+	return win
+}
+
+func (f *transformFilter) shifted(value float64) float64 {
+	return math.Max(value+f.TransformConfig.Shift, minBoxCoxValue)
+}
+
+// fitLambda finds the Box-Cox lambda that maximizes the log-likelihood of the
+// given windows' values.
+func (f *transformFilter) fitLambda(wins []window) float64 {
+	var values []float64
+	logSum := 0.0
+	for _, win := range wins {
+		if win.Missing() {
+			continue
+		}
+		value := f.shifted(win.Value)
+		values = append(values, value)
+		logSum += math.Log(value)
+	}
+	if len(values) < 2 {
+		return f.TransformConfig.Lambda
+	}
+
+	n := float64(len(values))
+	best, bestLikelihood := f.TransformConfig.Lambda, math.Inf(-1)
+	transformed := make([]float64, len(values))
+	for lambda := minBoxCoxLambda; lambda <= maxBoxCoxLambda; lambda += boxCoxLambdaStep {
+		mean := 0.0
+		for i, value := range values {
+			transformed[i] = boxCox(value, lambda)
+			mean += transformed[i] / n
+		}
+		variance := 0.0
+		for _, value := range transformed {
+			variance += (value - mean) * (value - mean) / n
+		}
+		if variance <= 0 {
+			continue
+		}
+		likelihood := -n/2*math.Log(variance) + (lambda-1)*logSum
+		if likelihood > bestLikelihood {
+			best, bestLikelihood = lambda, likelihood
+		}
+	}
+	return best
+}
+
+func boxCox(value, lambda float64) float64 {
+	if math.Abs(lambda) < boxCoxLambdaStep/2 {
+		return math.Log(value)
+	}
+	return (math.Pow(value, lambda) - 1) / lambda
+}
+
+func transformIsKnown(function string) bool {
+	for _, v := range transformFunctions {
+		if v == function {
+			return true
+		}
+	}
+	return false
+}
@@ -8,11 +8,30 @@ import (
 )
 
 type window struct {
-	Start       time.Time
-	End         time.Time
-	Series      string
-	Value       float64
+	Start      time.Time
+	End        time.Time
+	Slide      time.Duration
+	Resolution string
+	Series     string
+	SeriesKey  seriesKey
+	Value      float64
+	// OriginalValue is the window's value before it was transformed for
+	// detection.
+	OriginalValue float64
+	Aggregation   string
+	// Fill is the fill policy that created this window if no metrics actually
+	// fell within it, or empty if they did.
+	Fill        string
 	Passthrough []*message.Field
+	// Evict marks this as a notice that Series has been evicted, rather than
+	// as an actual window.
+	Evict bool
+}
+
+// Missing reports whether this window is a placeholder for a period without
+// any data, which detectors should not rule on.
+func (w window) Missing() bool {
+	return w.Fill == "Missing"
 }
 
 func windowFromMessage(m *message.Message) (window, error) {
@@ -42,7 +61,30 @@ func windowFromMessage(m *message.Message) (window, error) {
 		return window{}, err
 	}
 
-	return window{startTime, endTime, series.(string), value.(float64), nil}, nil
+	win := window{
+		Start:  startTime,
+		End:    endTime,
+		Series: series.(string),
+		Value:  value.(float64),
+	}
+	if orig, ok := m.GetFieldValue("original_value"); ok {
+		win.OriginalValue = orig.(float64)
+	} else {
+		win.OriginalValue = win.Value
+	}
+	if agg, ok := m.GetFieldValue("window_aggregation"); ok {
+		win.Aggregation = agg.(string)
+	}
+	if fill, ok := m.GetFieldValue("window_fill"); ok {
+		win.Fill = fill.(string)
+	}
+	if res, ok := m.GetFieldValue("resolution"); ok {
+		win.Resolution = res.(string)
+	}
+	if slide, ok := m.GetFieldValue("window_slide"); ok {
+		win.Slide = time.Duration(slide.(float64) * float64(time.Second))
+	}
+	return win, nil
 }
 
 func (w window) FillMessage(m *message.Message) error {
@@ -62,17 +104,45 @@ func (w window) FillMessage(m *message.Message) error {
 	if err != nil {
 		return errors.New("Could not create 'value' field")
 	}
+	origValue, err := message.NewField("original_value", w.OriginalValue, "count")
+	if err != nil {
+		return errors.New("Could not create 'original_value' field")
+	}
+	agg, err := message.NewField("window_aggregation", w.Aggregation, "")
+	if err != nil {
+		return errors.New("Could not create 'window_aggregation' field")
+	}
+	fill, err := message.NewField("window_fill", w.Fill, "")
+	if err != nil {
+		return errors.New("Could not create 'window_fill' field")
+	}
 	duration := w.End.Sub(w.Start)
 	durField, err := message.NewField("window_duration", duration.Seconds(), "seconds")
 	if err != nil {
 		return errors.New("Could not create 'duration' field")
 	}
+	resolution, err := message.NewField("resolution", w.Resolution, "")
+	if err != nil {
+		return errors.New("Could not create 'resolution' field")
+	}
+	slideField, err := message.NewField("window_slide", w.Slide.Seconds(), "seconds")
+	if err != nil {
+		return errors.New("Could not create 'window_slide' field")
+	}
 	m.SetTimestamp(w.End.UnixNano())
 	m.AddField(series)
+	m.AddField(resolution)
 	m.AddField(start)
 	m.AddField(end)
 	m.AddField(durField)
+	m.AddField(slideField)
 	m.AddField(value)
+	m.AddField(origValue)
+	m.AddField(agg)
+	m.AddField(fill)
+	if err = w.SeriesKey.FillMessage(m); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -0,0 +1,74 @@
+package hekaanom
+
+import "time"
+
+var (
+	defaultWindowUnit = "seconds"
+	windowUnits       = []string{"seconds", "days", "weeks", "months"}
+)
+
+// The Unix epoch fell on a Thursday, so weeks starting on Monday begin three
+// days earlier.
+const epochWeekdayOffset = 3
+
+// calendarIndex returns the number of whole calendar units (in the window's
+// time zone, shifted by its offset) between the Unix epoch and t.
+func (f *windowFilter) calendarIndex(t time.Time) int64 {
+	local := t.In(f.location)
+	year, month, day := local.Date()
+	days := civilDays(year, month, day)
+
+	var i int64
+	switch f.WindowConfig.WindowUnit {
+	case "days":
+		i = days
+	case "weeks":
+		i = floorDiv(days+epochWeekdayOffset, 7)
+	case "months":
+		i = int64(year-1970)*12 + int64(month-1)
+	}
+
+	// The offset may push t into the unit before or after its calendar date.
+	for t.Before(f.calendarTime(i)) {
+		i--
+	}
+	for !t.Before(f.calendarTime(i + 1)) {
+		i++
+	}
+	return i
+}
+
+// calendarTime returns the time at which the i'th calendar unit since the Unix
+// epoch begins.
+func (f *windowFilter) calendarTime(i int64) time.Time {
+	offset := int(f.WindowConfig.WindowOffset)
+	switch f.WindowConfig.WindowUnit {
+	case "weeks":
+		i = i*7 - epochWeekdayOffset
+		fallthrough
+	case "days":
+		date := time.Unix(i*24*60*60, 0).UTC()
+		return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, offset, 0, f.location)
+	case "months":
+		return time.Date(1970, time.Month(i+1), 1, 0, 0, offset, 0, f.location)
+	}
+	return time.Unix(i, 0).In(f.location)
+}
+
+// civilDays returns the number of days between 1970-01-01 and the given date.
+func civilDays(year int, month time.Month, day int) int64 {
+	return floorDiv(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix(), 24*60*60)
+}
+
+func floorDiv(a, b int64) int64 {
+	return (a - floorMod(a, b)) / b
+}
+
+func unitIsKnown(unit string) bool {
+	for _, v := range windowUnits {
+		if v == unit {
+			return true
+		}
+	}
+	return false
+}
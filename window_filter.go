@@ -2,29 +2,164 @@ package hekaanom
 
 import (
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/montanaflynn/stats"
+	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 )
 
+var (
+	defaultWindowFill        = "None"
+	defaultRealtimeGrace     = int64(60)
+	windowFills              = []string{"None", "Zero", "CarryForward", "Linear", "Missing"}
+	defaultWindowAggregation = "Sum"
+	windowAggFunctions       = map[string]func(*windowState) float64{
+		"Sum":   func(s *windowState) float64 { return s.sum },
+		"Count": func(s *windowState) float64 { return s.weight },
+		"Last":  func(s *windowState) float64 { return s.last },
+		"Min":   func(s *windowState) float64 { return s.min },
+		"Max":   func(s *windowState) float64 { return s.max },
+		"Mean": func(s *windowState) float64 {
+			if s.weight == 0 {
+				return 0.0
+			}
+			return s.sum / s.weight
+		},
+		"P50": percentileAgg(50),
+		"P95": percentileAgg(95),
+		"P99": percentileAgg(99),
+	}
+)
+
 type windower interface {
 	pipeline.HasConfigStruct
 	pipeline.Plugin
 	Connect(in <-chan metric) chan window
+	LateMetrics() chan metric
+	FlushExpiredWindows(now time.Time, out chan window)
 }
 
 type WindowConfig struct {
-	// The number of seconds that constitute a single window.
+	// The name of this resolution, which is attached to every window, ruling,
+	// and span it produces. Defaults to the window width followed by its unit,
+	// e.g. "3600seconds" or "1days".
+	Resolution string `toml:"resolution"`
+
+	// The number of seconds (or other WindowUnit) that constitute a single
+	// window. Windows are aligned to multiples of this width since the Unix
+	// epoch, so every series shares the same window boundaries.
 	WindowWidth int64 `toml:"window_width"`
+
+	// The unit in which WindowWidth and WindowSlide are given. Possible values
+	// are "seconds", "days", "weeks", and "months". Days, weeks (which start on
+	// Monday) and months follow the calendar in TimeZone, so a day may be 23 or
+	// 25 hours long across a daylight saving change. Defaults to "seconds".
+	WindowUnit string `toml:"window_unit"`
+
+	// The number of units between the starts of consecutive windows. When
+	// this is less than WindowWidth, windows overlap and each metric counts
+	// towards every window it falls within, e.g. a WindowWidth of 3600 and
+	// a WindowSlide of 300 emits an hour-long window every five minutes. Window
+	// boundaries are then aligned to multiples of this slide instead of the
+	// width. Defaults to WindowWidth, i.e. windows don't overlap.
+	WindowSlide int64 `toml:"window_slide"`
+
+	// The number of seconds by which window boundaries are shifted away from
+	// multiples of WindowWidth. For example, a WindowWidth of 86400 and
+	// a WindowOffset of 21600 gives days that start at 6am. For calendar units,
+	// the offset is applied to the local wall clock time.
+	WindowOffset int64 `toml:"window_offset"`
+
+	// The IANA name of the time zone (e.g. "America/New_York") in which window
+	// boundaries are aligned, so that daily windows start at local midnight.
+	// Window widths in seconds are counted on the local wall clock, so a
+	// WindowWidth of 86400 gives a 25-hour window on the day clocks go back.
+	// Defaults to "UTC".
+	TimeZone string `toml:"time_zone"`
+
+	// Aggregation is the function used to combine the values of the metrics
+	// that fall within a window into the window's value. Possible values are
+	// "Sum", "Mean", "Min", "Max", "Last", "Count", "P50", "P95", and "P99".
+	// "Sum", "Mean", and "Count" take each metric's sample rate into account,
+	// so that they estimate the unsampled totals. Defaults to "Sum".
+	Aggregation string `toml:"aggregation"`
+
+	// Fill is the policy used to create windows for periods in which a series
+	// received no metrics at all. "None" skips those periods entirely, "Zero"
+	// gives them a value of zero, "CarryForward" repeats the value of the last
+	// window, "Linear" interpolates between the windows on either side of the
+	// gap, and "Missing" emits them marked as missing so detectors can skip
+	// over them. In realtime, a gap that's closed by the timer before the
+	// series' next metric arrives can't be interpolated, so "Linear" carries
+	// the last value forward instead. Defaults to "None".
+	Fill string `toml:"fill"`
+
+	// The number of seconds a metric may arrive behind the latest metric seen
+	// for its series and still be counted. Windows are held open until the
+	// latest metric is this far past their end. Metrics that arrive after
+	// their window has been closed are injected as "anom.late" messages
+	// instead. Defaults to zero, i.e. windows close as soon as a metric for
+	// a later window arrives.
+	AllowedLateness int64 `toml:"allowed_lateness"`
+
+	// When the filter runs in realtime, the number of seconds, on top of
+	// AllowedLateness, that the wall clock must be past a window's end before
+	// the window is closed without a later metric having arrived. This leaves
+	// time for metrics that are delayed on their way in, so that they aren't
+	// counted as late and quiet series don't get a false empty window.
+	// Defaults to 60. Zero closes windows as soon as the wall clock passes
+	// their end plus AllowedLateness.
+	RealtimeGrace *int64 `toml:"realtime_grace"`
 }
 
 type windowFilter struct {
-	windows map[string]*window
+	sync.Mutex
+	windows    map[string]*seriesWindows
+	late       chan metric
+	location   *time.Location
+	aggregator func(*windowState) float64
+	keepValues bool
 	*WindowConfig
 }
 
+// seriesWindows holds the windows of a single series that are still open, in
+// order of their start, along with what we need to know about the windows
+// that have already been flushed.
+type seriesWindows struct {
+	series      string
+	seriesKey   seriesKey
+	passthrough []*message.Field
+	open        []*windowState
+	// The latest metric timestamp seen in this series.
+	latest time.Time
+	// The start of the last flushed window, and its value.
+	flushed   time.Time
+	prevValue float64
+}
+
+// windowState is a window that is still accepting metrics, along with the
+// running values needed to compute its aggregation once it's flushed.
+type windowState struct {
+	window
+	count  int
+	weight float64
+	sum    float64
+	min    float64
+	max    float64
+	last   float64
+	values []float64
+}
+
 func (f *windowFilter) ConfigStruct() interface{} {
-	return &WindowConfig{}
+	return &WindowConfig{
+		WindowUnit:  defaultWindowUnit,
+		Aggregation: defaultWindowAggregation,
+		TimeZone:    "UTC",
+		Fill:        defaultWindowFill,
+	}
 }
 
 func (f *windowFilter) Init(config interface{}) error {
@@ -32,7 +167,57 @@ func (f *windowFilter) Init(config interface{}) error {
 	if f.WindowConfig.WindowWidth <= 0 {
 		return errors.New("'window_width' setting must be greater than zero.")
 	}
-	f.windows = map[string]*window{}
+	if f.WindowConfig.WindowUnit == "" {
+		f.WindowConfig.WindowUnit = defaultWindowUnit
+	}
+	if !unitIsKnown(f.WindowConfig.WindowUnit) {
+		return errors.New("Unknown 'window_unit'.")
+	}
+	if f.WindowConfig.Resolution == "" {
+		f.WindowConfig.Resolution = fmt.Sprintf("%d%s", f.WindowConfig.WindowWidth, f.WindowConfig.WindowUnit)
+	}
+	if f.WindowConfig.WindowSlide == 0 {
+		f.WindowConfig.WindowSlide = f.WindowConfig.WindowWidth
+	}
+	if f.WindowConfig.WindowSlide < 0 || f.WindowConfig.WindowSlide > f.WindowConfig.WindowWidth {
+		return errors.New("'window_slide' setting must be greater than zero and no greater than 'window_width'.")
+	}
+	if f.WindowConfig.AllowedLateness < 0 {
+		return errors.New("'allowed_lateness' setting must not be negative.")
+	}
+	if f.WindowConfig.RealtimeGrace == nil {
+		grace := defaultRealtimeGrace
+		f.WindowConfig.RealtimeGrace = &grace
+	}
+	if *f.WindowConfig.RealtimeGrace < 0 {
+		return errors.New("'realtime_grace' setting must not be negative.")
+	}
+	if f.WindowConfig.Aggregation == "" {
+		f.WindowConfig.Aggregation = defaultWindowAggregation
+	}
+	location, err := time.LoadLocation(f.WindowConfig.TimeZone)
+	if err != nil {
+		return err
+	}
+	f.location = location
+	aggregator, ok := windowAggFunctions[f.WindowConfig.Aggregation]
+	if !ok {
+		return errors.New("Unknown window 'aggregation'.")
+	}
+	f.aggregator = aggregator
+	// Only percentiles need every value in the window to be kept around.
+	switch f.WindowConfig.Aggregation {
+	case "P50", "P95", "P99":
+		f.keepValues = true
+	}
+	if f.WindowConfig.Fill == "" {
+		f.WindowConfig.Fill = defaultWindowFill
+	}
+	if !fillIsKnown(f.WindowConfig.Fill) {
+		return errors.New("Unknown window 'fill'.")
+	}
+	f.windows = map[string]*seriesWindows{}
+	f.late = make(chan metric)
 	return nil
 }
 
@@ -40,34 +225,339 @@ func (f *windowFilter) Connect(in <-chan metric) chan window {
 	out := make(chan window)
 	go func() {
 		defer close(out)
+		defer close(f.late)
 		for metric := range in {
-			win, ok := f.windows[metric.Series]
+			f.Lock()
+			if metric.Evict {
+				delete(f.windows, metric.Series)
+				out <- window{Series: metric.Series, Evict: true}
+				f.Unlock()
+				continue
+			}
+
+			s, ok := f.windows[metric.Series]
 			if !ok {
-				win = &window{
-					Start:       metric.Timestamp,
-					Series:      metric.Series,
-					Passthrough: metric.Passthrough,
+				s = &seriesWindows{
+					series:      metric.Series,
+					seriesKey:   metric.SeriesKey,
+					passthrough: metric.Passthrough,
 				}
-				f.windows[metric.Series] = win
+				f.windows[metric.Series] = s
 			}
 
-			windowAge := metric.Timestamp.Sub(win.Start)
-			if int64(windowAge/time.Second) >= f.WindowConfig.WindowWidth {
-				f.flushWindow(win, out)
-				win.Start = metric.Timestamp
+			added := false
+			for _, start := range f.windowStarts(metric.Timestamp) {
+				if f.windowIsClosed(s, start) {
+					continue
+				}
+				f.addValue(f.openWindow(s, start), metric.Value, metric.Weight())
+				added = true
+			}
+			if !added {
+				// Every window this metric falls within has already been flushed.
+				f.late <- metric
+				f.Unlock()
+				continue
 			}
 
-			win.Value += metric.Value
-			win.End = metric.Timestamp
+			if metric.Timestamp.After(s.latest) {
+				s.latest = metric.Timestamp
+			}
+			f.flushClosedWindows(s, f.watermark(s), out)
+			f.Unlock()
 		}
 	}()
 	return out
 }
 
-func (f *windowFilter) flushWindow(win *window, out chan window) error {
-	// Add one window width to the end of the width because the end is exclusive
-	win.End = win.End.Add(time.Duration(f.WindowConfig.WindowWidth) * time.Second)
-	out <- *win
-	*win = window{Series: win.Series, Passthrough: win.Passthrough}
-	return nil
+// LateMetrics returns the channel on which metrics that arrived after their
+// window was flushed are sent. It's closed along with the window channel.
+func (f *windowFilter) LateMetrics() chan metric {
+	return f.late
+}
+
+// watermark returns the time before which windows in s may no longer receive
+// metrics.
+func (f *windowFilter) watermark(s *seriesWindows) time.Time {
+	if s.latest.IsZero() {
+		return s.latest
+	}
+	return s.latest.Add(-time.Duration(f.WindowConfig.AllowedLateness) * time.Second)
+}
+
+// windowIsClosed reports whether the window in s beginning at start can no
+// longer receive metrics, either because it has already been flushed or
+// because it ends before the series' watermark.
+func (f *windowFilter) windowIsClosed(s *seriesWindows, start time.Time) bool {
+	if !s.flushed.IsZero() && !start.After(s.flushed) {
+		return true
+	}
+	return !f.windowEnd(start).After(f.watermark(s))
+}
+
+// openWindow returns the open window in s that begins at start, creating it
+// if it doesn't exist yet.
+func (f *windowFilter) openWindow(s *seriesWindows, start time.Time) *windowState {
+	i := 0
+	for ; i < len(s.open); i++ {
+		if s.open[i].Start.Equal(start) {
+			return s.open[i]
+		}
+		if s.open[i].Start.After(start) {
+			break
+		}
+	}
+	win := &windowState{window: window{
+		Start:       start,
+		End:         f.windowEnd(start),
+		Series:      s.series,
+		SeriesKey:   s.seriesKey,
+		Passthrough: s.passthrough,
+	}}
+	s.open = append(s.open, nil)
+	copy(s.open[i+1:], s.open[i:])
+	s.open[i] = win
+	return win
+}
+
+// FlushExpiredWindows closes every window that ended more than
+// AllowedLateness plus RealtimeGrace seconds before now, even if no later
+// metric has arrived for its series. Series that have stopped receiving
+// metrics get a window for every period that has passed since their last
+// window, so that detectors see the drop. These windows follow Fill, except
+// that "Linear" can't know the value to interpolate towards yet, and so
+// carries the last value forward instead. With a Fill of "None", they're
+// empty windows with a value of zero.
+func (f *windowFilter) FlushExpiredWindows(now time.Time, out chan window) {
+	f.Lock()
+	defer f.Unlock()
+	wait := f.WindowConfig.AllowedLateness + *f.WindowConfig.RealtimeGrace
+	watermark := now.Add(-time.Duration(wait) * time.Second)
+	for _, s := range f.windows {
+		f.flushClosedWindows(s, watermark, out)
+		if len(s.open) > 0 || s.flushed.IsZero() {
+			continue
+		}
+		for start := f.nextStart(s.flushed); !f.windowEnd(start).After(watermark); start = f.nextStart(start) {
+			var expired window
+			switch f.WindowConfig.Fill {
+			case "None":
+				expired = f.gapWindow(s, start, "", 0.0)
+			case "CarryForward", "Linear":
+				expired = f.gapWindow(s, start, "CarryForward", s.prevValue)
+			default:
+				expired = f.gapWindow(s, start, f.WindowConfig.Fill, 0.0)
+			}
+			out <- expired
+			s.flushed = start
+		}
+	}
+}
+
+// flushClosedWindows flushes, in order, every open window in s that ends at or
+// before watermark.
+func (f *windowFilter) flushClosedWindows(s *seriesWindows, watermark time.Time, out chan window) {
+	for len(s.open) > 0 && !s.open[0].End.After(watermark) {
+		win := s.open[0]
+		s.open = s.open[1:]
+		f.flushWindow(s, win, out)
+	}
+}
+
+// windowStart returns the start of the latest window that contains t.
+func (f *windowFilter) windowStart(t time.Time) time.Time {
+	if f.WindowConfig.WindowUnit != "seconds" {
+		i := f.calendarIndex(t)
+		return f.calendarTime(i - floorMod(i, f.WindowConfig.WindowSlide))
+	}
+	// Boundaries fall on whole seconds, so the latest one at or before t is
+	// the latest one before the second after t.
+	start := f.prevOnWallClock(t.Unix()+1, f.WindowConfig.WindowOffset, f.WindowConfig.WindowSlide)
+	return time.Unix(start, 0).In(f.location)
+}
+
+// wallClock returns the local wall clock time of t in the window's time zone,
+// as a number of seconds since the Unix epoch.
+func (f *windowFilter) wallClock(t time.Time) int64 {
+	_, zoneOffset := t.In(f.location).Zone()
+	return t.Unix() + int64(zoneOffset)
+}
+
+// nextOnWallClock returns the first second after from at which the local wall
+// clock reads base plus a multiple of step. When clocks go back, the wall
+// clock reads the repeated times twice, and either may be returned; when
+// they go forward, the skipped times are never returned.
+func (f *windowFilter) nextOnWallClock(from, base, step int64) int64 {
+	for {
+		zone := time.Unix(from, 0).In(f.location)
+		_, offset := zone.Zone()
+		_, end := zone.ZoneBounds()
+		wall := from + int64(offset)
+		next := wall + step - floorMod(wall-base, step) - int64(offset)
+		if end.IsZero() || next < end.Unix() {
+			return next
+		}
+		// The clocks change first, so carry on from the change.
+		from = end.Unix()
+		if floorMod(f.wallClock(end)-base, step) == 0 {
+			return from
+		}
+	}
+}
+
+// prevOnWallClock returns the last second before from at which the local wall
+// clock reads base plus a multiple of step.
+func (f *windowFilter) prevOnWallClock(from, base, step int64) int64 {
+	for {
+		zone := time.Unix(from-1, 0).In(f.location)
+		_, offset := zone.Zone()
+		start, _ := zone.ZoneBounds()
+		wall := from + int64(offset)
+		prev := wall - 1 - floorMod(wall-1-base, step) - int64(offset)
+		if start.IsZero() || prev >= start.Unix() {
+			return prev
+		}
+		// The clocks changed first, so carry on from before the change.
+		from = start.Unix()
+	}
+}
+
+// windowStarts returns the starts of every window that contains t, latest
+// first. Unless windows overlap, there's only one.
+func (f *windowFilter) windowStarts(t time.Time) []time.Time {
+	var starts []time.Time
+	for start := f.windowStart(t); f.windowEnd(start).After(t); start = f.prevStart(start) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+func (f *windowFilter) windowEnd(start time.Time) time.Time {
+	return f.addUnits(start, f.WindowConfig.WindowWidth)
+}
+
+func (f *windowFilter) nextStart(start time.Time) time.Time {
+	return f.addUnits(start, f.WindowConfig.WindowSlide)
+}
+
+func (f *windowFilter) prevStart(start time.Time) time.Time {
+	return f.addUnits(start, -f.WindowConfig.WindowSlide)
+}
+
+// addUnits moves the window boundary start n units forward or backward.
+// Seconds are counted on the local wall clock, so that e.g. windows of 86400
+// seconds follow local days across daylight saving changes, while windows of
+// 300 seconds carry on every five minutes through the hour that's repeated
+// when clocks go back.
+func (f *windowFilter) addUnits(start time.Time, n int64) time.Time {
+	if f.WindowConfig.WindowUnit != "seconds" {
+		return f.calendarTime(f.calendarIndex(start) + n)
+	}
+	base := f.wallClock(start)
+	if n < 0 {
+		return time.Unix(f.prevOnWallClock(start.Unix(), base, -n), 0).In(f.location)
+	}
+	return time.Unix(f.nextOnWallClock(start.Unix(), base, n), 0).In(f.location)
+}
+
+func (f *windowFilter) addValue(win *windowState, value, weight float64) {
+	if win.count == 0 || value < win.min {
+		win.min = value
+	}
+	if win.count == 0 || value > win.max {
+		win.max = value
+	}
+	win.count++
+	win.weight += weight
+	win.sum += value * weight
+	win.last = value
+	if f.keepValues {
+		win.values = append(win.values, value)
+	}
+}
+
+func (f *windowFilter) flushWindow(s *seriesWindows, win *windowState, out chan window) {
+	win.Value = f.aggregator(win)
+	win.OriginalValue = win.Value
+	win.Aggregation = f.WindowConfig.Aggregation
+	win.Resolution = f.WindowConfig.Resolution
+	win.Slide = f.nextStart(win.Start).Sub(win.Start)
+	if !s.flushed.IsZero() {
+		f.fillGap(s, win.Start, win.Value, out)
+	}
+	out <- win.window
+	s.flushed = win.Start
+	s.prevValue = win.Value
+}
+
+// fillGap emits a window for each period between the last window flushed in
+// s and the window starting at to, whose value is next. These periods have
+// already been determined to contain no metrics.
+func (f *windowFilter) fillGap(s *seriesWindows, to time.Time, next float64, out chan window) {
+	if f.WindowConfig.Fill == "None" {
+		return
+	}
+	var gaps []window
+	for start := f.nextStart(s.flushed); start.Before(to); start = f.nextStart(start) {
+		gaps = append(gaps, f.gapWindow(s, start, f.WindowConfig.Fill, 0.0))
+	}
+	for i, gap := range gaps {
+		switch f.WindowConfig.Fill {
+		case "CarryForward":
+			gap.Value = s.prevValue
+		case "Linear":
+			step := float64(i+1) / float64(len(gaps)+1)
+			gap.Value = s.prevValue + (next-s.prevValue)*step
+		}
+		gap.OriginalValue = gap.Value
+		out <- gap
+	}
+}
+
+// gapWindow returns a window of s, beginning at start, for a period in which
+// the series received no metrics.
+func (f *windowFilter) gapWindow(s *seriesWindows, start time.Time, fill string, value float64) window {
+	return window{
+		Start:         start,
+		End:           f.windowEnd(start),
+		Slide:         f.nextStart(start).Sub(start),
+		Series:        s.series,
+		Resolution:    f.WindowConfig.Resolution,
+		Aggregation:   f.WindowConfig.Aggregation,
+		Fill:          fill,
+		Value:         value,
+		OriginalValue: value,
+		SeriesKey:     s.seriesKey,
+		Passthrough:   s.passthrough,
+	}
+}
+
+func percentileAgg(percent float64) func(*windowState) float64 {
+	return func(s *windowState) float64 {
+		if len(s.values) == 0 {
+			return 0.0
+		}
+		value, err := stats.Percentile(s.values, percent)
+		if err != nil {
+			return 0.0
+		}
+		return value
+	}
+}
+
+func floorMod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
+
+func fillIsKnown(fill string) bool {
+	for _, v := range windowFills {
+		if v == fill {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,209 @@
+package hekaanom
+
+import (
+	"testing"
+	"time"
+)
+
+// Windows given in seconds should follow the local wall clock across
+// daylight saving changes, rather than overlapping one another or leaving
+// gaps.
+func TestWindowsFollowLocalDaysAcrossDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone database unavailable:", err)
+	}
+
+	day := 24 * time.Hour
+	fiveMinutes := 5 * time.Minute
+	// Clocks go back on 2026-11-01, and forward on 2026-03-08.
+	fallBack := time.Date(2026, 11, 1, 0, 0, 0, 0, loc)
+	tests := []struct {
+		width   int64
+		from    time.Time
+		every   time.Duration
+		lengths []time.Duration
+	}{
+		{86400, fallBack.AddDate(0, 0, -1), time.Hour, []time.Duration{day, day + time.Hour, day}},
+		{86400, time.Date(2026, 3, 7, 0, 0, 0, 0, loc), time.Hour, []time.Duration{day, day - time.Hour, day}},
+		// From midnight until 3am, through the repeated hour from 1am to 2am.
+		{300, fallBack, time.Minute, repeatDuration(fiveMinutes, 4*12)},
+	}
+	for _, test := range tests {
+		f := new(windowFilter)
+		conf := f.ConfigStruct().(*WindowConfig)
+		conf.WindowWidth = test.width
+		conf.TimeZone = "America/New_York"
+		if err := f.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+
+		in := make(chan metric)
+		out := f.Connect(in)
+		go func() {
+			for range f.LateMetrics() {
+				t.Error("metric counted as late")
+			}
+		}()
+		go func() {
+			end := test.from
+			for _, length := range test.lengths {
+				end = end.Add(length)
+			}
+			for ts := test.from; ts.Before(end); ts = ts.Add(test.every) {
+				in <- metric{Timestamp: ts, Series: "a", Value: 1}
+			}
+			// Close the last window.
+			in <- metric{Timestamp: end, Series: "a", Value: 1}
+			close(in)
+		}()
+
+		var windows []window
+		for win := range out {
+			windows = append(windows, win)
+		}
+		if len(windows) != len(test.lengths) {
+			t.Fatalf("got %d %d-second windows from %s, want %d", len(windows), test.width, test.from, len(test.lengths))
+		}
+		for i, win := range windows {
+			if i == 0 && !win.Start.Equal(test.from) {
+				t.Errorf("first %d-second window starts at %s, want %s", test.width, win.Start, test.from)
+			}
+			if i > 0 && !win.Start.Equal(windows[i-1].End) {
+				t.Errorf("%d-second window %d starts at %s, but the one before ends at %s",
+					test.width, i, win.Start, windows[i-1].End)
+			}
+			if length := win.End.Sub(win.Start); length != test.lengths[i] {
+				t.Errorf("%d-second window %d is %s long, want %s", test.width, i, length, test.lengths[i])
+			}
+			if want := float64(test.lengths[i] / test.every); win.Value != want {
+				t.Errorf("%d-second window %d has value %v, want %v", test.width, i, win.Value, want)
+			}
+		}
+	}
+}
+
+func repeatDuration(d time.Duration, n int) []time.Duration {
+	durations := make([]time.Duration, n)
+	for i := range durations {
+		durations[i] = d
+	}
+	return durations
+}
+
+// Hourly boundaries that fall in the hour skipped when clocks go forward
+// shouldn't leave windows stuck in place.
+func TestAddUnitsSkipsMissingHour(t *testing.T) {
+	f := new(windowFilter)
+	conf := f.ConfigStruct().(*WindowConfig)
+	conf.WindowWidth = 3600
+	conf.TimeZone = "America/New_York"
+	if err := f.Init(conf); err != nil {
+		t.Skip("time zone database unavailable:", err)
+	}
+
+	start := time.Date(2026, 3, 8, 1, 0, 0, 0, f.location)
+	next := f.nextStart(start)
+	if want := time.Date(2026, 3, 8, 3, 0, 0, 0, f.location); !next.Equal(want) {
+		t.Errorf("next start after %s is %s, want %s", start, next, want)
+	}
+	if prev := f.prevStart(next); !prev.Equal(start) {
+		t.Errorf("previous start before %s is %s, want %s", next, prev, start)
+	}
+}
+
+// In realtime, windows should be held open for a grace period after the wall
+// clock passes their end, so that slightly delayed metrics still count.
+func TestFlushExpiredWindowsWaitsForGrace(t *testing.T) {
+	f := new(windowFilter)
+	conf := f.ConfigStruct().(*WindowConfig)
+	conf.WindowWidth = 60
+	if err := f.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan metric)
+	out := f.Connect(in)
+	go func() {
+		for range f.LateMetrics() {
+			t.Error("metric counted as late")
+		}
+	}()
+	// Each metric for "b" is only received once the one before it has been
+	// added.
+	in <- metric{Timestamp: time.Unix(600, 0), Series: "a", Value: 1}
+	in <- metric{Timestamp: time.Unix(6000, 0), Series: "b", Value: 1}
+
+	flushed := make(chan window, 10)
+	end := time.Unix(660, 0)
+	f.FlushExpiredWindows(end.Add(30*time.Second), flushed)
+	if len(flushed) != 0 {
+		t.Fatalf("window flushed %d seconds after its end", 30)
+	}
+
+	// A metric delayed on its way in still makes it into its window.
+	in <- metric{Timestamp: time.Unix(650, 0), Series: "a", Value: 1}
+	in <- metric{Timestamp: time.Unix(6000, 0), Series: "b", Value: 1}
+	f.FlushExpiredWindows(end.Add(time.Duration(defaultRealtimeGrace+1)*time.Second), flushed)
+	if len(flushed) != 1 {
+		t.Fatalf("got %d windows after the grace period, want 1", len(flushed))
+	}
+	if win := <-flushed; win.Value != 2 {
+		t.Errorf("window has value %v, want 2", win.Value)
+	}
+
+	close(in)
+	for range out {
+	}
+}
+
+// Windows closed by the timer for a quiet series should follow the fill
+// policy, so detectors don't mistake missing data for a drop to zero.
+func TestFlushExpiredWindowsFollowsFill(t *testing.T) {
+	tests := []struct {
+		fill      string
+		wantFill  string
+		wantValue float64
+	}{
+		{"None", "", 0},
+		{"Zero", "Zero", 0},
+		{"Missing", "Missing", 0},
+		{"CarryForward", "CarryForward", 5},
+		{"Linear", "CarryForward", 5},
+	}
+	for _, test := range tests {
+		f := new(windowFilter)
+		conf := f.ConfigStruct().(*WindowConfig)
+		conf.WindowWidth = 60
+		conf.Fill = test.fill
+		if err := f.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+
+		in := make(chan metric)
+		out := f.Connect(in)
+		flushed := make(chan window, 10)
+		go func() {
+			for win := range out {
+				flushed <- win
+			}
+		}()
+		in <- metric{Timestamp: time.Unix(600, 0), Series: "a", Value: 2}
+		in <- metric{Timestamp: time.Unix(660, 0), Series: "a", Value: 5}
+		// Once this is received, the metrics before it have been added.
+		in <- metric{Timestamp: time.Unix(6000, 0), Series: "b", Value: 1}
+		if win := <-flushed; win.Value != 2 {
+			t.Fatalf("%s: first window has value %v, want 2", test.fill, win.Value)
+		}
+
+		// Flush the window from 660 to 720, then one the series got nothing in.
+		f.FlushExpiredWindows(time.Unix(780+defaultRealtimeGrace, 0), flushed)
+		<-flushed
+		win := <-flushed
+		if !win.Start.Equal(time.Unix(720, 0)) || win.Fill != test.wantFill || win.Value != test.wantValue {
+			t.Errorf("%s: expired window starts at %d with fill %q and value %v, want 720, %q and %v",
+				test.fill, win.Start.Unix(), win.Fill, win.Value, test.wantFill, test.wantValue)
+		}
+		close(in)
+	}
+}